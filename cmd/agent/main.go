@@ -1,43 +1,150 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/qate/q8-agent/internal/api"
+	"github.com/qate/q8-agent/internal/audit"
+	"github.com/qate/q8-agent/internal/auth"
 	"github.com/qate/q8-agent/internal/config"
 	"github.com/qate/q8-agent/internal/docker"
 	"github.com/qate/q8-agent/internal/fs"
+	"github.com/qate/q8-agent/internal/metrics"
+	"github.com/qate/q8-agent/internal/secure"
 	"github.com/qate/q8-agent/internal/service"
+	"github.com/qate/q8-agent/internal/state"
+	"github.com/qate/q8-agent/internal/system"
 )
 
+// shutdownTimeout bounds how long running jobs may take to finish on shutdown
+const shutdownTimeout = 5 * time.Minute
+
 func main() {
 	// 1. Load config
 	cfg := config.LoadConfig()
 
+	if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		if err := rekey(cfg); err != nil {
+			log.Fatalf("Fatal: rekey: %s", err)
+		}
+		return
+	}
+
+	tokens, err := auth.Load(cfg.TokensFile, cfg.AdminToken)
+	if err != nil {
+		log.Fatalf("Fatal: %s", err)
+	}
+	authMode, err := auth.ParseMode(cfg.AuthMode)
+	if err != nil {
+		log.Fatalf("Fatal: %s", err)
+	}
+	if err := tokens.Configure(authMode, cfg.HMACMaxSkew); err != nil {
+		log.Fatalf("Fatal: %s", err)
+	}
+
+	var tlsReloader *secure.TLSReloader
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" || cfg.TLSClientCAFile != "" {
+		if tlsReloader, err = secure.NewTLSReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile); err != nil {
+			log.Fatalf("Fatal: %s", err)
+		}
+	}
+
+	masterKey, err := secure.LoadKey(cfg.MasterKey, cfg.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Fatal: %s", err)
+	}
+
 	// 2. Initialize components
-	fsManager := fs.NewManager(cfg.TenantsRoot)
-	dockerRunner := docker.NewRunner()
+	fsManager := fs.NewManager(cfg.TenantsRoot, masterKey)
+	registries, err := state.OpenRegistries(filepath.Join(cfg.StateDir, "registries.json"), filepath.Join(cfg.StateDir, "tmp"), masterKey)
+	if err != nil {
+		log.Fatalf("Fatal: %s", err)
+	}
+	if cfg.RegistryAuthFile != "" {
+		if err := registries.LoadFile(cfg.RegistryAuthFile); err != nil {
+			log.Fatalf("Fatal: %s", err)
+		}
+	}
+	if cfg.RegistryHost != "" {
+		if err := registries.LoadEnv(cfg.RegistryHost, cfg.RegistryUser, cfg.RegistryPassword); err != nil {
+			log.Fatalf("Fatal: %s", err)
+		}
+	}
+
+	reg := metrics.NewRegistry()
+	dockerEngine := docker.NewClient(cfg.DockerSocket)
+	dockerRunner := docker.NewRunner(dockerEngine, registries)
+	dockerRunner.Instrument(reg)
 
 	// Check if docker is available
+	if err := dockerEngine.Ping(context.Background()); err != nil {
+		log.Fatalf("Fatal: docker engine is not reachable at %s: %s", cfg.DockerSocket, err)
+	}
 	if !dockerRunner.IsInstalled() {
 		log.Fatal("Fatal: docker compose is not installed or accessible")
 	}
 
-	orchestrator := service.NewOrchestrator(cfg, fsManager, dockerRunner)
-	handler := api.NewHandler(orchestrator)
+	registry, err := state.Open(filepath.Join(cfg.StateDir, "tenants.json"))
+	if err != nil {
+		log.Fatalf("Fatal: %s", err)
+	}
+
+	secrets, err := state.OpenSecrets(filepath.Join(cfg.StateDir, "secrets.json"), masterKey)
+	if err != nil {
+		log.Fatalf("Fatal: %s", err)
+	}
+
+	orchestrator := service.NewOrchestrator(cfg, fsManager, dockerRunner, registry, secrets)
+	orchestrator.Instrument(reg)
+	if n, err := orchestrator.ImportTenants(); err != nil {
+		log.Printf("Warning: importing existing tenants: %s", err)
+	} else if n > 0 {
+		log.Printf("Imported %d existing tenant(s) into the registry", n)
+	}
+	jobs := service.NewJobManager(cfg.JobWorkers, cfg.JobQueueSize, cfg.JobRetention)
+	jobs.Instrument(reg)
+	jobs.Start()
+	stats := system.NewCollector(cfg.TenantsRoot, dockerEngine)
+	auditLog, err := audit.Open(cfg.AuditLog, int64(cfg.AuditMaxSize), cfg.AuditMaxFiles)
+	if err != nil {
+		log.Fatalf("Fatal: %s", err)
+	}
+	defer auditLog.Close()
+	handler := api.NewHandler(orchestrator, jobs, stats, registries, auditLog)
 
 	// 3. Setup Routes
 	mux := http.NewServeMux()
 
 	// Add routes with Auth Middleware
-	mux.HandleFunc("/v1/tenants/provision", api.AuthMiddleware(cfg, handler.Provision))
-	mux.HandleFunc("/v1/tenants/teardown/", api.AuthMiddleware(cfg, handler.Teardown))
-	mux.HandleFunc("/v1/tenants/restart/", api.AuthMiddleware(cfg, handler.Restart))
-	mux.HandleFunc("/v1/tenants/status/", api.AuthMiddleware(cfg, handler.Status))
-	mux.HandleFunc("/v1/tenants/logs/", api.AuthMiddleware(cfg, handler.Logs))
-	mux.HandleFunc("/v1/tenants/images/", api.AuthMiddleware(cfg, handler.Images))
+	mux.HandleFunc("/v1/tenants", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.ListTenants))
+	mux.HandleFunc("/v1/tenants/", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Tenant))
+	mux.HandleFunc("/v1/tenants/provision", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Provision))
+	mux.HandleFunc("/v1/tenants/update", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Update))
+	mux.HandleFunc("/v1/tenants/teardown/", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Teardown))
+	mux.HandleFunc("/v1/tenants/restart/", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Restart))
+	mux.HandleFunc("/v1/tenants/suspend/", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Suspend))
+	mux.HandleFunc("/v1/tenants/resume/", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Resume))
+	mux.HandleFunc("/v1/tenants/status/", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Status))
+	mux.HandleFunc("/v1/tenants/logs/", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Logs))
+	mux.HandleFunc("/v1/tenants/images/", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Images))
+	mux.HandleFunc("/v1/archives", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Archives))
+	mux.HandleFunc("/v1/archives/", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Archive))
+	mux.HandleFunc("/v1/jobs/", api.AuthMiddleware(tokens, auth.ResourceTenants, handler.Job))
+	mux.HandleFunc("/v1/audit", api.AuthMiddleware(tokens, auth.ResourceAudit, handler.AuditLog))
+	mux.HandleFunc("/v1/system/stats", api.AuthMiddleware(tokens, auth.ResourceSystem, handler.SystemStats))
+	mux.HandleFunc("/v1/registries", api.AuthMiddleware(tokens, auth.ResourceRegistries, handler.Registries))
+	mux.HandleFunc("/v1/registries/", api.AuthMiddleware(tokens, auth.ResourceRegistries, handler.Registry))
+	mux.HandleFunc("/v1/databases/mongo", api.AuthMiddleware(tokens, auth.ResourceDatabases, handler.Databases))
+	mux.HandleFunc("/v1/databases/mongo/", api.AuthMiddleware(tokens, auth.ResourceDatabases, handler.Database))
+	mux.HandleFunc("/metrics", api.AuthMiddleware(tokens, auth.ResourceSystem, api.MetricsHandler(reg)))
 
 	// Health check (no auth)
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -47,25 +154,106 @@ func main() {
 	// 4. Start Server
 	log.Printf("Q8 Agent starting on port %s...", cfg.Port)
 	log.Printf("Tenants root: %s", cfg.TenantsRoot)
+	log.Printf("State dir: %s", cfg.StateDir)
+	log.Printf("Audit log: %s", cfg.AuditLog)
+	log.Printf("Encryption at rest: %t", masterKey.Enabled())
+	log.Printf("API tokens: %d (auth mode: %s)", tokens.Len(), tokens.Mode())
+	log.Printf("TLS: %t (client certificates required: %t)", tlsReloader != nil, tlsReloader != nil && tlsReloader.MutualTLS())
 	printRoutes()
 
 	server := &http.Server{
 		Addr:    ":" + cfg.Port,
-		Handler: mux,
+		Handler: api.RequestID(api.Instrument(reg, mux, api.Audit(auditLog, mux))),
+	}
+	server.RegisterOnShutdown(handler.CloseStreams)
+	if tlsReloader != nil {
+		server.TLSConfig = tlsReloader.TLSConfig()
 	}
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %s", err)
+	// Purge expired archives in the background when a retention is set
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	if cfg.ArchiveRetention > 0 && cfg.ArchiveJanitorInterval > 0 {
+		log.Printf("Archive retention: %s", cfg.ArchiveRetention)
+		go orchestrator.RunArchiveJanitor(janitorCtx, cfg.ArchiveRetention, cfg.ArchiveJanitorInterval)
+	}
+
+	go func() {
+		var err error
+		if tlsReloader != nil {
+			// Certificates come from TLSConfig
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %s", err)
+		}
+	}()
+
+	// Reload rotated certificates on SIGHUP
+	if tlsReloader != nil {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := tlsReloader.Reload(); err != nil {
+					log.Printf("Warning: TLS reload failed, keeping the current certificates: %s", err)
+					continue
+				}
+				log.Println("TLS certificates reloaded")
+			}
+		}()
+	}
+
+	// 5. Graceful shutdown: stop accepting requests, then let running jobs finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Shutting down...")
+	stopJanitor()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Warning: HTTP shutdown: %s", err)
+	}
+	if err := jobs.Shutdown(ctx); err != nil {
+		log.Printf("Warning: jobs cancelled before completion: %s", err)
 	}
 }
 
 func printRoutes() {
 	log.Println("Supported API Methods:")
-	log.Println("  [POST] /v1/tenants/provision  - Provision a new tenant environment")
-	log.Println("  [POST] /v1/tenants/teardown/  - Remove a tenant environment")
-	log.Println("  [POST] /v1/tenants/restart/   - Restart tenant containers")
+	log.Println("  [GET]  /v1/tenants            - List managed tenants")
+	log.Println("  [GET]  /v1/tenants/{sub}      - Describe a tenant")
+	log.Println("  [POST] /v1/tenants/{sub}/services/{svc}/restart - Restart one service (async)")
+	log.Println("  [GET]  /v1/tenants/{sub}/services/{svc}/logs    - Get or stream the logs of one service")
+	log.Println("  [GET]  /v1/tenants/{sub}/services/{svc}/status  - Get the container status of one service")
+	log.Println("  [POST] /v1/tenants/provision  - Provision a new tenant environment (async)")
+	log.Println("  [POST] /v1/tenants/update     - Pull and recreate changed services (async)")
+	log.Println("  [POST] /v1/tenants/teardown/  - Remove a tenant environment (async)")
+	log.Println("  [POST] /v1/tenants/restart/   - Restart tenant containers (async)")
+	log.Println("  [POST] /v1/tenants/suspend/   - Stop tenant containers, keeping volumes and config (async)")
+	log.Println("  [POST] /v1/tenants/resume/    - Start a suspended tenant again (async)")
 	log.Println("  [GET]  /v1/tenants/status/    - Get container status")
-	log.Println("  [GET]  /v1/tenants/logs/      - Get container logs")
+	log.Println("  [GET]  /v1/tenants/logs/      - Get container logs (?follow=true streams)")
 	log.Println("  [GET]  /v1/tenants/images/    - Get container image information")
+	log.Println("  [GET]  /v1/archives           - List archives of torn down tenants")
+	log.Println("  [GET]  /v1/archives/{name}    - Describe an archive")
+	log.Println("  [DEL]  /v1/archives/{name}    - Purge an archive and its retained volumes")
+	log.Println("  [POST] /v1/archives/{name}/restore - Restore an archive as an active tenant (async)")
+	log.Println("  [GET]  /v1/jobs/              - Get asynchronous job state")
+	log.Println("  [GET]  /v1/audit              - Query the audit log of mutating calls")
+	log.Println("  [GET]  /v1/system/stats       - Host telemetry (CPU/RAM/Disk/containers)")
+	log.Println("  [GET]  /v1/registries         - List registry credentials (no secrets)")
+	log.Println("  [PUT]  /v1/registries/{host}  - Set registry credentials")
+	log.Println("  [DEL]  /v1/registries/{host}  - Remove registry credentials")
+	log.Println("  [GET]  /v1/databases/mongo    - List agent-managed MongoDB databases and users")
+	log.Println("  [POST] /v1/databases/mongo    - Create a MongoDB database user")
+	log.Println("  [DEL]  /v1/databases/mongo/{db} - Drop a database and its managed users")
+	log.Println("  [POST] /v1/databases/mongo/{db}/users/{user}/rotate - Rotate a user password")
+	log.Println("  [GET]  /metrics               - Prometheus metrics (requests, operations, docker failures, tenants)")
 	log.Println("  [GET]  /health                - Agent health check")
 }
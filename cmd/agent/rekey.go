@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/qate/q8-agent/internal/config"
+	"github.com/qate/q8-agent/internal/fs"
+	"github.com/qate/q8-agent/internal/secure"
+	"github.com/qate/q8-agent/internal/state"
+)
+
+// rekey re-encrypts the agent state and every tenant env file, active or
+// archived, from the old master key (Q8_OLD_MASTER_KEY[_FILE]) to the current
+// one (Q8_MASTER_KEY[_FILE]). Either may be unset for cleartext, which also
+// enables or disables encryption of an existing installation. The agent must
+// not be running. Files already under the new key are accepted, so a run that
+// failed midway can simply be repeated.
+func rekey(cfg *config.Config) error {
+	oldKey, err := secure.LoadKey(cfg.OldMasterKey, cfg.OldMasterKeyFile)
+	if err != nil {
+		return err
+	}
+	newKey, err := secure.LoadKey(cfg.MasterKey, cfg.MasterKeyFile)
+	if err != nil {
+		return err
+	}
+
+	registries, err := openEither(func(c *secure.Cipher) (*state.RegistryStore, error) {
+		return state.OpenRegistries(filepath.Join(cfg.StateDir, "registries.json"), filepath.Join(cfg.StateDir, "tmp"), c)
+	}, oldKey, newKey)
+	if err != nil {
+		return err
+	}
+	if err := registries.Reseal(newKey); err != nil {
+		return err
+	}
+
+	secrets, err := openEither(func(c *secure.Cipher) (*state.SecretStore, error) {
+		return state.OpenSecrets(filepath.Join(cfg.StateDir, "secrets.json"), c)
+	}, oldKey, newKey)
+	if err != nil {
+		return err
+	}
+	if err := secrets.Reseal(newKey); err != nil {
+		return err
+	}
+
+	n, err := fs.NewManager(cfg.TenantsRoot, newKey).RekeyEnvFiles(oldKey, newKey)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Re-keyed agent state and %d tenant directories (encryption %t)", n, newKey.Enabled())
+	return nil
+}
+
+// openEither opens a store with oldKey, or with newKey when an earlier run
+// already resealed it. The error of oldKey is returned when both fail.
+func openEither[T any](open func(*secure.Cipher) (T, error), oldKey, newKey *secure.Cipher) (T, error) {
+	s, err := open(oldKey)
+	if err == nil {
+		return s, nil
+	}
+	if s, newErr := open(newKey); newErr == nil {
+		return s, nil
+	}
+	return s, err
+}
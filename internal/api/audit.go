@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/qate/q8-agent/internal/audit"
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// Bounds of the audit query page size
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditKey is the context key of the audit entry of a request
+type auditKey struct{}
+
+// noteAudit lets the handlers of an audited request fill in its entry
+func noteAudit(r *http.Request, fn func(e *audit.Entry)) {
+	if e, ok := r.Context().Value(auditKey{}).(*audit.Entry); ok {
+		fn(e)
+	}
+}
+
+// Audit records every mutating request served by mux in the audit log: the
+// caller identity, the tenant and job it concerns, a digest of the body and
+// the outcome. Read-only requests are not recorded.
+func Audit(auditLog *audit.Log, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		_, pattern := mux.Handler(r)
+		entry := &audit.Entry{
+			Time:       start.UTC(),
+			RequestID:  RequestIDFrom(r.Context()),
+			RemoteAddr: r.RemoteAddr,
+			Operation:  r.Method + " " + pattern,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+		}
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			entry.CertSubject = r.TLS.VerifiedChains[0][0].Subject.String()
+		}
+
+		// Hash the body as received, then hand it to the handler unchanged
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		body, err := readBody(r)
+		sum := sha256.Sum256(body)
+		entry.RequestSHA256 = hex.EncodeToString(sum[:])
+		if err != nil {
+			writeError(rec, r, err)
+		} else {
+			mux.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditKey{}, entry)))
+		}
+
+		entry.Status = rec.status
+		entry.DurationMS = time.Since(start).Milliseconds()
+		switch {
+		case rec.status == http.StatusAccepted:
+			entry.Outcome = audit.OutcomeAccepted
+		case rec.status < 400:
+			entry.Outcome = audit.OutcomeSuccess
+		case rec.status == http.StatusUnauthorized || rec.status == http.StatusForbidden:
+			entry.Outcome = audit.OutcomeDenied
+		default:
+			entry.Outcome = audit.OutcomeFailure
+		}
+		if err := auditLog.Write(*entry); err != nil {
+			log.Printf("Warning: audit: %s", err)
+		}
+	})
+}
+
+// statusRecorder captures the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// AuditLog handles queries of the audit log, newest entries first:
+// GET /v1/audit[?since=&until=&tenant=&identity=&limit=]
+func (h *Handler) AuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	now := time.Now()
+	filter := audit.Filter{
+		Tenant:   query.Get("tenant"),
+		Identity: query.Get("identity"),
+		Limit:    defaultAuditLimit,
+		// Tokens restricted to some tenants only see those
+		Tenants: allowedTenants(r),
+	}
+
+	var err error
+	if filter.Since, err = parseLogsTime(query, "since", now); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if filter.Until, err = parseLogsTime(query, "until", now); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if filter.Tenant != "" {
+		if err := domain.ValidateSubdomain(filter.Tenant); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := authorizeTenant(r, filter.Tenant); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			writeError(w, r, invalidRequest(fmt.Sprintf("invalid limit (1-%d)", maxAuditLimit)))
+			return
+		}
+		filter.Limit = n
+	}
+
+	entries, err := h.audit.Query(filter)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries, "count": len(entries)})
+}
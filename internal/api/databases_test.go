@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qate/q8-agent/internal/auth"
+)
+
+func TestDatabasesRefuseRestrictedTokens(t *testing.T) {
+	h := &Handler{}
+	token := &auth.Token{Name: "acme", Scopes: []string{"*"}, Tenants: []string{"acme"}}
+
+	tests := []struct {
+		method, path string
+		handler      http.HandlerFunc
+	}{
+		{http.MethodGet, "/v1/databases/mongo", h.Databases},
+		{http.MethodPost, "/v1/databases/mongo", h.Databases},
+		{http.MethodDelete, "/v1/databases/mongo/acme", h.Database},
+		{http.MethodPost, "/v1/databases/mongo/acme/users/acme/rotate", h.Database},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r = r.WithContext(auth.WithToken(r.Context(), token))
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, w.Code, http.StatusForbidden)
+		}
+	}
+}
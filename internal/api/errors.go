@@ -0,0 +1,50 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// Errors answered by the handlers themselves
+var (
+	errMethodNotAllowed = domain.NewError(domain.CodeMethodNotAllowed, "method not allowed")
+	errInvalidBody      = domain.NewError(domain.CodeInvalidRequest, "invalid request body")
+)
+
+// errorResponse is the JSON envelope of every error answer
+type errorResponse struct {
+	Code      domain.ErrorCode `json:"code"`
+	Message   string           `json:"message"`
+	Details   any              `json:"details,omitempty"`
+	RequestID string           `json:"request_id,omitempty"`
+}
+
+// writeError answers with the status mapped from the code of err and the
+// JSON error envelope. Errors without a code are reported as internal errors.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	resp := newErrorResponse(r, err)
+	writeJSON(w, resp.Code.HTTPStatus(), resp)
+}
+
+// newErrorResponse builds the error envelope of err, logging internal errors
+func newErrorResponse(r *http.Request, err error) errorResponse {
+	code := domain.CodeOf(err)
+	requestID := RequestIDFrom(r.Context())
+	if code == domain.CodeInternal {
+		log.Printf("Request %s %s %s failed: %s", requestID, r.Method, r.URL.Path, err)
+	}
+
+	return errorResponse{
+		Code:      code,
+		Message:   err.Error(),
+		Details:   domain.DetailsOf(err),
+		RequestID: requestID,
+	}
+}
+
+// invalidRequest returns a CodeInvalidRequest error with message
+func invalidRequest(message string) error {
+	return domain.NewError(domain.CodeInvalidRequest, message)
+}
@@ -1,203 +1,784 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/qate/q8-agent/internal/audit"
 	"github.com/qate/q8-agent/internal/domain"
 	"github.com/qate/q8-agent/internal/service"
+	"github.com/qate/q8-agent/internal/state"
+	"github.com/qate/q8-agent/internal/system"
+)
+
+// Pagination bounds for list endpoints
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
 )
 
 // Handler handles API requests
 type Handler struct {
-	service *service.Orchestrator
+	service    *service.Orchestrator
+	jobs       *service.JobManager
+	stats      *system.Collector
+	registries *state.RegistryStore
+	audit      *audit.Log
+
+	// streams is cancelled by CloseStreams to end long-lived responses
+	streams     context.Context
+	stopStreams context.CancelFunc
 }
 
 // NewHandler creates a new API handler
-func NewHandler(s *service.Orchestrator) *Handler {
-	return &Handler{service: s}
+func NewHandler(s *service.Orchestrator, jobs *service.JobManager, stats *system.Collector, registries *state.RegistryStore, auditLog *audit.Log) *Handler {
+	streams, stopStreams := context.WithCancel(context.Background())
+	return &Handler{
+		service:     s,
+		jobs:        jobs,
+		stats:       stats,
+		registries:  registries,
+		audit:       auditLog,
+		streams:     streams,
+		stopStreams: stopStreams,
+	}
+}
+
+// CloseStreams ends the followed log streams so that the server can shut down
+func (h *Handler) CloseStreams() {
+	h.stopStreams()
 }
 
 // Provision handles tenant provisioning
 func (h *Handler) Provision(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
 	var req domain.TenantProvisionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, r, errInvalidBody)
 		return
 	}
 
 	if req.ID == "" || req.Subdomain == "" {
-		http.Error(w, "Missing required fields (id, subdomain)", http.StatusBadRequest)
+		writeError(w, r, invalidRequest("missing required fields (id, subdomain)"))
 		return
 	}
 
-	if err := h.service.ProvisionTenant(req); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := domain.ValidateSubdomain(req.Subdomain); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := authorizeTenant(r, req.Subdomain); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if _, err := domain.SecretPlaceholders(req.EnvContent); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"status": "provisioned", "id": req.ID})
+	h.submit(w, r, domain.JobProvision, req.Subdomain, map[string]string{"id": req.ID}, func(ctx context.Context) error {
+		return h.service.ProvisionTenant(ctx, req)
+	})
 }
 
 // Teardown handles tenant teardown
 func (h *Handler) Teardown(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
 	// Simple path parsing /v1/tenants/teardown/{subdomain}
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 4 {
-		http.Error(w, "Missing subdomain", http.StatusBadRequest)
+	subdomain, err := tenantFromPath(r, "/v1/tenants/teardown/")
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	subdomain := parts[len(parts)-1]
 
-	if err := h.service.TeardownTenant(subdomain); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// The body is optional: without one the volumes are kept
+	var req domain.TenantTeardownRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "torn_down", "subdomain": subdomain})
+	extra := map[string]string{"subdomain": subdomain, "mode": string(req.Mode)}
+	h.submit(w, r, domain.JobTeardown, subdomain, extra, func(ctx context.Context) error {
+		_, err := h.service.TeardownTenant(ctx, subdomain, req.Mode)
+		return err
+	})
 }
 
 // Restart handles tenant restart
 func (h *Handler) Restart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	subdomain, err := tenantFromPath(r, "/v1/tenants/restart/")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	h.submit(w, r, domain.JobRestart, subdomain, map[string]string{"subdomain": subdomain}, func(ctx context.Context) error {
+		return h.service.RestartTenant(ctx, subdomain)
+	})
+}
+
+// Suspend handles tenant suspension: containers are stopped, volumes and
+// config are kept
+func (h *Handler) Suspend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	subdomain, err := tenantFromPath(r, "/v1/tenants/suspend/")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	h.submit(w, r, domain.JobSuspend, subdomain, map[string]string{"subdomain": subdomain}, func(ctx context.Context) error {
+		return h.service.SuspendTenant(ctx, subdomain)
+	})
+}
+
+// Resume handles restarting a suspended tenant
+func (h *Handler) Resume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	subdomain, err := tenantFromPath(r, "/v1/tenants/resume/")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	h.submit(w, r, domain.JobResume, subdomain, map[string]string{"subdomain": subdomain}, func(ctx context.Context) error {
+		return h.service.ResumeTenant(ctx, subdomain)
+	})
+}
+
+// ListTenants handles listing of managed tenants with filtering and pagination
+func (h *Handler) ListTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := domain.TenantFilter{
+		State: domain.TenantState(query.Get("state")),
+		Query: query.Get("q"),
+		Limit: defaultPageSize,
+		// Tokens restricted to some tenants only see those
+		Subdomains: allowedTenants(r),
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeError(w, r, invalidRequest(fmt.Sprintf("invalid limit (1-%d)", maxPageSize)))
+			return
+		}
+		filter.Limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, invalidRequest("invalid offset"))
+			return
+		}
+		filter.Offset = n
+	}
+
+	tenants, total := h.service.ListTenants(filter)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"tenants": tenants,
+		"total":   total,
+		"limit":   filter.Limit,
+		"offset":  filter.Offset,
+	})
+}
+
+// Tenant handles requests on a single tenant and its services:
+// GET  /v1/tenants/{subdomain}
+// POST /v1/tenants/{subdomain}/services/{service}/restart
+// GET  /v1/tenants/{subdomain}/services/{service}/logs
+// GET  /v1/tenants/{subdomain}/services/{service}/status
+func (h *Handler) Tenant(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/tenants/"), "/")
+	if err := domain.ValidateSubdomain(parts[0]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	subdomain := parts[0]
+	if err := authorizeTenant(r, subdomain); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+
+		details, err := h.service.DescribeTenant(r.Context(), subdomain)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, details)
+		return
+	}
+
+	if len(parts) != 4 || parts[1] != "services" {
+		writeError(w, r, domain.NewError(domain.CodeNotFound, "not found"))
+		return
+	}
+	h.serviceOperation(w, r, subdomain, parts[2], parts[3])
+}
+
+// serviceOperation handles an operation on a single service of a tenant
+func (h *Handler) serviceOperation(w http.ResponseWriter, r *http.Request, subdomain, service, action string) {
+	if err := domain.ValidateServiceName(service); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	method := http.MethodGet
+	if action == "restart" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "restart":
+		// Reject unknown services before queueing a job
+		if err := h.service.CheckServices(r.Context(), subdomain, []string{service}); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		extra := map[string]string{"subdomain": subdomain, "service": service}
+		h.submit(w, r, domain.JobRestart, subdomain, extra, func(ctx context.Context) error {
+			return h.service.RestartService(ctx, subdomain, service)
+		})
+
+	case "logs":
+		opts, err := parseLogsQuery(r.URL.Query(), time.Now())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		opts.Services = []string{service}
+		h.writeLogs(w, r, subdomain, opts)
+
+	case "status":
+		status, err := h.service.GetServiceStatus(r.Context(), subdomain, service)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+
+	default:
+		writeError(w, r, domain.NewError(domain.CodeNotFound, "not found"))
+	}
+}
+
+// Archives handles listing of the archives of torn down tenants:
+// GET /v1/archives[?subdomain=]
+func (h *Handler) Archives(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
+	subdomain := r.URL.Query().Get("subdomain")
+	if subdomain != "" {
+		if err := domain.ValidateSubdomain(subdomain); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := authorizeTenant(r, subdomain); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	archives, err := h.service.ListArchives(subdomain)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if allowed := allowedTenants(r); allowed != nil {
+		archives = slices.DeleteFunc(archives, func(a domain.Archive) bool { return !slices.Contains(allowed, a.Subdomain) })
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"archives": archives, "total": len(archives)})
+}
+
+// Archive handles requests on a single archive:
+// GET    /v1/archives/{name}
+// DELETE /v1/archives/{name}
+// POST   /v1/archives/{name}/restore
+func (h *Handler) Archive(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/archives/"), "/")
+	subdomain, err := domain.ParseArchiveName(parts[0])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := authorizeTenant(r, subdomain); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	name := parts[0]
+
+	switch {
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			archive, err := h.service.GetArchive(name)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, archive)
+
+		case http.MethodDelete:
+			result, err := h.service.PurgeArchive(r.Context(), name)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, result)
+
+		default:
+			writeError(w, r, errMethodNotAllowed)
+		}
+
+	case len(parts) == 2 && parts[1] == "restore":
+		if r.Method != http.MethodPost {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		// Reject unknown archives before queueing a job
+		if _, err := h.service.GetArchive(name); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		extra := map[string]string{"archive": name, "subdomain": subdomain}
+		h.submit(w, r, domain.JobRestore, subdomain, extra, func(ctx context.Context) error {
+			_, err := h.service.RestoreArchive(ctx, name)
+			return err
+		})
+
+	default:
+		writeError(w, r, domain.NewError(domain.CodeNotFound, "not found"))
+	}
+}
+
+// Job handles asynchronous job status requests
+func (h *Handler) Job(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	// Simple path parsing /v1/jobs/{id}
 	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 4 {
-		http.Error(w, "Missing subdomain", http.StatusBadRequest)
+	if len(parts) < 4 || parts[len(parts)-1] == "" {
+		writeError(w, r, invalidRequest("missing job id"))
+		return
+	}
+	id := parts[len(parts)-1]
+
+	// Jobs of tenants the token may not access are not found either, so
+	// that restricted tokens cannot tell which job IDs exist
+	job, ok := h.jobs.Get(id)
+	if ok && authorizeTenant(r, job.Subdomain) != nil {
+		ok = false
+	}
+	// Generated secrets are handed out to the first authorized reader only
+	if ok {
+		job, ok = h.jobs.Claim(id)
+	}
+	if !ok {
+		writeError(w, r, domain.NewError(domain.CodeJobNotFound, "job not found"))
 		return
 	}
-	subdomain := parts[len(parts)-1]
+	writeJSON(w, http.StatusOK, job)
+}
 
-	if err := h.service.RestartTenant(subdomain); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// Update handles lightweight image updates of an existing tenant
+func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "restarted", "subdomain": subdomain})
+	var req domain.TenantUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	if err := domain.ValidateSubdomain(req.Subdomain); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := authorizeTenant(r, req.Subdomain); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	h.submit(w, r, domain.JobUpdate, req.Subdomain, map[string]string{"subdomain": req.Subdomain}, func(ctx context.Context) error {
+		_, err := h.service.UpdateTenant(ctx, req)
+		return err
+	})
 }
 
 // Status handles tenant status request
 func (h *Handler) Status(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 4 {
-		http.Error(w, "Missing subdomain", http.StatusBadRequest)
+	subdomain, err := tenantFromPath(r, "/v1/tenants/status/")
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	subdomain := parts[len(parts)-1]
 
-	status, err := h.service.GetTenantStatus(subdomain)
+	status, err := h.service.GetTenantStatus(r.Context(), subdomain)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(status))
+	writeJSON(w, http.StatusOK, status)
 }
 
 // Logs handles tenant logs request
 func (h *Handler) Logs(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 4 {
-		http.Error(w, "Missing subdomain", http.StatusBadRequest)
+	subdomain, err := tenantFromPath(r, "/v1/tenants/logs/")
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	subdomain := parts[len(parts)-1]
-
-	// Simple tail parsing from query param
-	tail := 100
-	if t := r.URL.Query().Get("tail"); t != "" {
-		fmt.Sscanf(t, "%d", &tail)
-	}
 
-	logs, err := h.service.GetTenantLogs(subdomain, tail)
+	opts, err := parseLogsQuery(r.URL.Query(), time.Now())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(logs))
+	h.writeLogs(w, r, subdomain, opts)
 }
 
 // Images handles tenant images request
 func (h *Handler) Images(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 4 {
-		http.Error(w, "Missing subdomain", http.StatusBadRequest)
+	subdomain, err := tenantFromPath(r, "/v1/tenants/images/")
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	subdomain := parts[len(parts)-1]
 
-	images, err := h.service.GetTenantImages(subdomain)
+	images, err := h.service.GetTenantImages(r.Context(), subdomain)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(images))
+	writeJSON(w, http.StatusOK, images)
+}
+
+// SystemStats handles host telemetry requests
+func (h *Handler) SystemStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	stats, err := h.stats.Collect(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Tokens restricted to some tenants only see the containers of those
+	if allowed := allowedTenants(r); allowed != nil {
+		maps.DeleteFunc(stats.Containers.Tenants, func(sub string, _ system.ContainerCounts) bool {
+			return !slices.Contains(allowed, sub)
+		})
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// Registries handles listing of configured registry credentials
+func (h *Handler) Registries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.registries.List())
+}
+
+// Registry handles setting and removing the credentials of a registry:
+// PUT|DELETE /v1/registries/{host}
+func (h *Handler) Registry(w http.ResponseWriter, r *http.Request) {
+	host := strings.TrimPrefix(r.URL.Path, "/v1/registries/")
+	if err := state.ValidateRegistryHost(host); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var req domain.RegistryCredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, errInvalidBody)
+			return
+		}
+		if req.Username == "" || req.Password == "" {
+			writeError(w, r, invalidRequest("missing required fields (username, password)"))
+			return
+		}
+
+		if err := h.registries.Set(host, req); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "configured", "host": host})
+
+	case http.MethodDelete:
+		found, err := h.registries.Delete(host)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !found {
+			writeError(w, r, domain.NewError(domain.CodeNotFound, "registry not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "removed", "host": host})
+
+	default:
+		writeError(w, r, errMethodNotAllowed)
+	}
+}
+
+// Databases handles listing of agent-managed mongo databases and user creation:
+// GET|POST /v1/databases/mongo. Databases are not tied to tenants, so tokens
+// restricted to some tenants may not manage them.
+func (h *Handler) Databases(w http.ResponseWriter, r *http.Request) {
+	if err := refuseRestricted(r, "manage databases"); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		databases, err := h.service.ListMongoDatabases(r.Context())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, databases)
+
+	case http.MethodPost:
+		h.CreateDatabase(w, r)
+
+	default:
+		writeError(w, r, errMethodNotAllowed)
+	}
+}
+
+// Database handles dropping a mongo database and rotating user passwords:
+// DELETE /v1/databases/mongo/{database}
+// POST   /v1/databases/mongo/{database}/users/{user}/rotate
+// Like Databases, it refuses tokens restricted to some tenants.
+func (h *Handler) Database(w http.ResponseWriter, r *http.Request) {
+	if err := refuseRestricted(r, "manage databases"); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/databases/mongo/"), "/")
+	if err := domain.ValidateMongoDatabase("database", parts[0]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	database := parts[0]
+
+	switch {
+	case len(parts) == 1:
+		if r.Method != http.MethodDelete {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+
+		result, err := h.service.DropMongoDatabase(r.Context(), database)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case len(parts) == 4 && parts[1] == "users" && parts[3] == "rotate":
+		if r.Method != http.MethodPost {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		if err := domain.ValidateMongoUser("user", parts[2]); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		// The body is optional: without one the agent generates the password
+		var req domain.MongoPasswordRotateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, r, errInvalidBody)
+			return
+		}
+		if req.Password != "" {
+			if err := domain.ValidateMongoPassword("password", req.Password); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		creds, err := h.service.RotateMongoPassword(r.Context(), database, parts[2], req.Password)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, creds)
+
+	default:
+		writeError(w, r, domain.NewError(domain.CodeNotFound, "not found"))
+	}
 }
 
 // CreateDatabase handles mongo database/user creation
 func (h *Handler) CreateDatabase(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
 	var req domain.MongoDBUserCreateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, r, errInvalidBody)
 		return
 	}
 
-	if req.Host == "" || req.AdminUser == "" || req.DatabaseName == "" {
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
+	if err := req.Validate(); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	if err := h.service.CreateMongoDBUser(req); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.service.CreateMongoDBUser(r.Context(), req); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"status": "database_configured"})
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "database_configured"})
+}
+
+// submit reserves the tenant and queues fn as an asynchronous job, answering
+// 202 on success and 409 when the tenant is busy with another operation
+func (h *Handler) submit(w http.ResponseWriter, r *http.Request, op domain.JobType, subdomain string, extra map[string]string, fn service.JobFunc) {
+	lease, err := h.service.Reserve(subdomain, op)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	job, err := h.jobs.Submit(op, subdomain, func(ctx context.Context) error {
+		defer lease.Release()
+		return fn(service.WithLease(ctx, lease))
+	})
+	if err != nil {
+		lease.Release()
+		writeError(w, r, err)
+		return
+	}
+
+	noteAudit(r, func(e *audit.Entry) { e.JobID = job.ID })
+	writeAccepted(w, job, extra)
+}
+
+// tenantFromPath extracts and validates the subdomain following prefix in the
+// URL path, and checks that the token of the request may access it
+func tenantFromPath(r *http.Request, prefix string) (string, error) {
+	subdomain := strings.TrimPrefix(r.URL.Path, prefix)
+	if err := domain.ValidateSubdomain(subdomain); err != nil {
+		return "", err
+	}
+	if err := authorizeTenant(r, subdomain); err != nil {
+		return "", err
+	}
+	return subdomain, nil
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAccepted answers 202 for a queued job, pointing the caller at its status URL
+func writeAccepted(w http.ResponseWriter, job domain.Job, extra map[string]string) {
+	body := map[string]string{
+		"status": string(job.State),
+		"job_id": job.ID,
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+
+	w.Header().Set("Location", "/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, body)
 }
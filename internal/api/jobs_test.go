@@ -0,0 +1,42 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qate/q8-agent/internal/auth"
+	"github.com/qate/q8-agent/internal/domain"
+	"github.com/qate/q8-agent/internal/service"
+)
+
+func TestJobOfOtherTenantNotFound(t *testing.T) {
+	jobs := service.NewJobManager(1, 1, time.Hour)
+	job, err := jobs.Submit(domain.JobRestart, "beta", func(context.Context) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{jobs: jobs}
+	token := &auth.Token{Name: "acme", Scopes: []string{"*"}, Tenants: []string{"acme"}}
+
+	get := func(id string, token *auth.Token) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/jobs/"+id, nil)
+		if token != nil {
+			r = r.WithContext(auth.WithToken(r.Context(), token))
+		}
+		w := httptest.NewRecorder()
+		h.Job(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	unknownStatus, unknownBody := get("0123456789abcdef", token)
+	otherStatus, otherBody := get(job.ID, token)
+	if unknownStatus != http.StatusNotFound || otherStatus != unknownStatus || otherBody != unknownBody {
+		t.Errorf("job of another tenant = %d %s, unknown job = %d %s, want the same 404", otherStatus, otherBody, unknownStatus, unknownBody)
+	}
+	if status, _ := get(job.ID, nil); status != http.StatusOK {
+		t.Errorf("status = %d for an unrestricted request, want %d", status, http.StatusOK)
+	}
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qate/q8-agent/internal/docker"
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// defaultLogTail is the number of lines returned per container by default
+const defaultLogTail = 100
+
+// parseLogsQuery reads the log filters of a logs request. Times are RFC 3339
+// timestamps or durations relative to now, such as 15m.
+func parseLogsQuery(query url.Values, now time.Time) (docker.ComposeLogsOptions, error) {
+	opts := docker.ComposeLogsOptions{LogsOptions: docker.LogsOptions{Tail: defaultLogTail}}
+
+	if t := query.Get("tail"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n < 0 {
+			return opts, &domain.ValidationError{Field: "tail", Value: t, Reason: "must be a non-negative integer, 0 for all lines"}
+		}
+		opts.Tail = n
+	}
+
+	var err error
+	if opts.Follow, err = parseLogsBool(query, "follow"); err != nil {
+		return opts, err
+	}
+	if opts.Timestamps, err = parseLogsBool(query, "timestamps"); err != nil {
+		return opts, err
+	}
+	if opts.Since, err = parseLogsTime(query, "since", now); err != nil {
+		return opts, err
+	}
+	if opts.Until, err = parseLogsTime(query, "until", now); err != nil {
+		return opts, err
+	}
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && opts.Until.Before(opts.Since) {
+		return opts, &domain.ValidationError{Field: "until", Value: query.Get("until"), Reason: "must not be before since"}
+	}
+
+	// service may be repeated or hold a comma-separated list
+	for _, v := range query["service"] {
+		for _, svc := range strings.Split(v, ",") {
+			if svc = strings.TrimSpace(svc); svc != "" {
+				opts.Services = append(opts.Services, svc)
+			}
+		}
+	}
+	return opts, nil
+}
+
+func parseLogsBool(query url.Values, name string) (bool, error) {
+	v := query.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, &domain.ValidationError{Field: name, Value: v, Reason: "must be true or false"}
+	}
+	return b, nil
+}
+
+func parseLogsTime(query url.Values, name string, now time.Time) (time.Time, error) {
+	v := query.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, &domain.ValidationError{Field: name, Value: v, Reason: "must be an RFC 3339 time or a duration such as 15m"}
+}
+
+// writeLogs answers the logs of a tenant selected by opts. Followed logs are
+// streamed until the client goes away or the server shuts down; cancelling
+// the context closes the engine log streams.
+func (h *Handler) writeLogs(w http.ResponseWriter, r *http.Request, subdomain string, opts docker.ComposeLogsOptions) {
+	if !opts.Follow {
+		var buf bytes.Buffer
+		if err := h.service.TenantLogs(r.Context(), subdomain, opts, &buf); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(h.streams, cancel)
+	defer stop()
+
+	stream := newLogStream(w, wantsEventStream(r))
+	stream.finish(r, h.service.TenantLogs(ctx, subdomain, opts, stream))
+}
+
+// logStream writes followed logs to a client as they arrive, either as
+// Server-Sent Events with one event per line or as chunked plain text. The
+// response is only committed on the first write, so errors raised before any
+// output can still be answered normally.
+type logStream struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	sse     bool
+	started bool
+	buf     []byte
+}
+
+func newLogStream(w http.ResponseWriter, sse bool) *logStream {
+	return &logStream{w: w, rc: http.NewResponseController(w), sse: sse}
+}
+
+func (s *logStream) start() {
+	if s.sse {
+		s.w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		s.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	s.w.Header().Set("Cache-Control", "no-cache")
+	// Ask reverse proxies not to buffer the stream
+	s.w.Header().Set("X-Accel-Buffering", "no")
+	s.w.WriteHeader(http.StatusOK)
+	s.started = true
+}
+
+func (s *logStream) Write(p []byte) (int, error) {
+	if !s.started {
+		s.start()
+	}
+
+	if !s.sse {
+		if _, err := s.w.Write(p); err != nil {
+			return 0, err
+		}
+		return len(p), s.rc.Flush()
+	}
+
+	s.buf = append(s.buf, p...)
+	i := bytes.LastIndexByte(s.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	if err := s.events(s.buf[:i]); err != nil {
+		return 0, err
+	}
+	s.buf = append(s.buf[:0], s.buf[i+1:]...)
+	return len(p), s.rc.Flush()
+}
+
+// events writes every line of lines as a data event
+func (s *logStream) events(lines []byte) error {
+	var out bytes.Buffer
+	for line := range bytes.SplitSeq(lines, []byte("\n")) {
+		out.WriteString("data: ")
+		out.Write(bytes.TrimSuffix(line, []byte("\r")))
+		out.WriteString("\n\n")
+	}
+	_, err := s.w.Write(out.Bytes())
+	return err
+}
+
+// finish ends the stream. An error raised after output started is sent as
+// an error event in SSE mode and only logged otherwise.
+func (s *logStream) finish(r *http.Request, err error) {
+	if !s.started {
+		if err != nil {
+			writeError(s.w, r, err)
+			return
+		}
+		s.start()
+		return
+	}
+
+	if s.sse && len(s.buf) > 0 {
+		s.events(s.buf)
+		s.buf = nil
+	}
+	if err == nil || r.Context().Err() != nil {
+		return
+	}
+
+	resp := newErrorResponse(r, err)
+	if !s.sse {
+		log.Printf("Request %s: log stream of %s ended: %s", resp.RequestID, r.URL.Path, err)
+		return
+	}
+	data, _ := json.Marshal(resp)
+	s.w.Write([]byte("event: error\ndata: "))
+	s.w.Write(data)
+	s.w.Write([]byte("\n\n"))
+	s.rc.Flush()
+}
+
+// wantsEventStream reports whether the client accepts Server-Sent Events
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
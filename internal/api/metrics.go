@@ -0,0 +1,67 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/qate/q8-agent/internal/metrics"
+)
+
+// metricsContentType is the media type of the Prometheus text format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// unmatchedRoute labels the requests no route of the mux serves
+const unmatchedRoute = "unmatched"
+
+// Instrument counts the requests served by next in reg, by route, method and
+// status, and records their latency. Routes are the patterns of mux, so that
+// tenant names in paths do not multiply the series.
+func Instrument(reg *metrics.Registry, mux *http.ServeMux, next http.Handler) http.Handler {
+	requests := reg.Counter("q8_http_requests_total",
+		"HTTP requests served, by route, method and status code", "route", "method", "code")
+	latency := reg.Histogram("q8_http_request_duration_seconds",
+		"Latency of HTTP requests, by route and method. Followed log streams last until closed.", metrics.DefaultBuckets, "route", "method")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = unmatchedRoute
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		default:
+			method = "other"
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		requests.Inc(route, method, strconv.Itoa(rec.status))
+		latency.Observe(time.Since(start).Seconds(), route, method)
+	})
+}
+
+// MetricsHandler serves the metrics of reg in the Prometheus text format:
+// GET /metrics. The metrics cover every tenant, so tokens restricted to some
+// tenants may not read them.
+func MetricsHandler(reg *metrics.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		if err := refuseRestricted(r, "read metrics"); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", metricsContentType)
+		if err := reg.WriteText(r.Context(), w); err != nil {
+			log.Printf("Warning: writing metrics: %s", err)
+		}
+	}
+}
@@ -1,32 +1,193 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"net/http"
+	"regexp"
 	"strings"
+	"time"
 
-	"github.com/qate/q8-agent/internal/config"
+	"github.com/qate/q8-agent/internal/audit"
+	"github.com/qate/q8-agent/internal/auth"
+	"github.com/qate/q8-agent/internal/domain"
 )
 
-// AuthMiddleware validates the Bearer token
-func AuthMiddleware(cfg *config.Config, next http.HandlerFunc) http.HandlerFunc {
+// RequestIDHeader carries the request ID, taken from the client when valid
+const RequestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// RequestID assigns every request an ID, echoed in the X-Request-ID response
+// header and in error responses
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFrom returns the ID of the request carried by ctx, if any
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// maxHashedBody bounds the request bodies read in full to compute their
+// digest, for signatures and the audit log
+const maxHashedBody = 16 << 20
+
+// AuthMiddleware authenticates the request with a client certificate, a
+// Bearer token or a request signature, depending on the auth mode, and checks
+// that the token grants the read scope of resource for GET requests and its
+// write scope otherwise. The token is added to the request context for tenant
+// checks.
+func AuthMiddleware(tokens *auth.Store, resource string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Unauthorized: Missing Authorization header", http.StatusUnauthorized)
+		token, err := authenticate(tokens, r)
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "Unauthorized: Invalid Authorization format", http.StatusUnauthorized)
+		scope := resource + ":write"
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			scope = resource + ":read"
+		}
+		if !token.HasScope(scope) {
+			writeError(w, r, &domain.Error{
+				Code:    domain.CodeForbidden,
+				Message: fmt.Sprintf("token %q lacks scope %s", token.Name, scope),
+				Details: map[string]string{"scope": scope},
+			})
 			return
 		}
 
-		if parts[1] != cfg.AdminToken {
-			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
-			return
+		noteAudit(r, func(e *audit.Entry) { e.Identity = token.Name })
+		next(w, r.WithContext(auth.WithToken(r.Context(), token)))
+	}
+}
+
+// authenticate returns the token of a request. A verified client certificate
+// mapped to a token authenticates the request on its own; credentials sent
+// along with it must belong to the same token.
+func authenticate(tokens *auth.Store, r *http.Request) (*auth.Token, error) {
+	var certToken *auth.Token
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		var err error
+		if certToken, err = tokens.AuthenticateCert(r.TLS.VerifiedChains[0][0], time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		if certToken != nil {
+			return certToken, nil
+		}
+		return nil, domain.NewError(domain.CodeUnauthorized, "missing Authorization header")
+	}
+
+	scheme, credentials, _ := strings.Cut(authHeader, " ")
+	var token *auth.Token
+	var err error
+	switch scheme {
+	case "Bearer":
+		token, err = tokens.Authenticate(credentials, time.Now())
+	case auth.SignatureScheme:
+		token, err = authenticateSigned(tokens, r, credentials)
+	default:
+		err = domain.NewError(domain.CodeUnauthorized, "invalid Authorization format")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if certToken != nil && token != certToken {
+		return nil, domain.NewError(domain.CodeUnauthorized, "credentials do not match the client certificate")
+	}
+	return token, nil
+}
+
+// authenticateSigned verifies the signature of a request. The body is read to
+// compute its digest and replaced for the handler.
+func authenticateSigned(tokens *auth.Store, r *http.Request, params string) (*auth.Token, error) {
+	req, err := auth.ParseSignatureParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(body)
+	req.Method = r.Method
+	req.RequestURI = r.URL.RequestURI()
+	req.BodySHA256 = hex.EncodeToString(sum[:])
+	return tokens.AuthenticateSigned(req, time.Now())
+}
+
+// readBody reads the body of a request and replaces it so that handlers can
+// read it again
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxHashedBody+1))
+	if err != nil {
+		return nil, invalidRequest("failed to read request body")
+	}
+	if len(body) > maxHashedBody {
+		return nil, invalidRequest(fmt.Sprintf("request body exceeds %d bytes", maxHashedBody))
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// authorizeTenant checks that the token of the request may act on a tenant,
+// which is recorded as the tenant of the audit entry
+func authorizeTenant(r *http.Request, subdomain string) error {
+	noteAudit(r, func(e *audit.Entry) { e.Tenant = subdomain })
+	if token := auth.FromContext(r.Context()); token != nil && !token.AllowsTenant(subdomain) {
+		return &domain.Error{
+			Code:    domain.CodeForbidden,
+			Message: fmt.Sprintf("token %q may not access tenant %s", token.Name, subdomain),
+			Details: map[string]string{"subdomain": subdomain},
 		}
+	}
+	return nil
+}
 
-		next(w, r)
+// allowedTenants returns the tenants the token of the request is restricted
+// to, or nil when it may access every tenant
+func allowedTenants(r *http.Request) []string {
+	if token := auth.FromContext(r.Context()); token != nil && token.Restricted() {
+		return token.Tenants
 	}
+	return nil
+}
+
+// refuseRestricted fails requests whose token is restricted to some tenants,
+// for routes whose resources are not tied to a tenant
+func refuseRestricted(r *http.Request, action string) error {
+	if token := auth.FromContext(r.Context()); token != nil && token.Restricted() {
+		return domain.NewError(domain.CodeForbidden, fmt.Sprintf("token %q is restricted to some tenants and may not %s", token.Name, action))
+	}
+	return nil
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
 }
@@ -0,0 +1,240 @@
+// Package audit keeps an append-only JSON lines record of the mutating API
+// calls, rotated by size
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Call outcomes
+const (
+	OutcomeSuccess  = "success"
+	OutcomeAccepted = "accepted"
+	OutcomeDenied   = "denied"
+	OutcomeFailure  = "failure"
+)
+
+// Entry records one API call
+type Entry struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id,omitempty"`
+	Identity      string    `json:"identity,omitempty"`
+	CertSubject   string    `json:"cert_subject,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Operation     string    `json:"operation"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Tenant        string    `json:"tenant,omitempty"`
+	JobID         string    `json:"job_id,omitempty"`
+	RequestSHA256 string    `json:"request_sha256"`
+	Status        int       `json:"status"`
+	Outcome       string    `json:"outcome"`
+	DurationMS    int64     `json:"duration_ms"`
+}
+
+// Filter selects audit entries. Zero fields match everything.
+type Filter struct {
+	Since    time.Time
+	Until    time.Time
+	Tenant   string
+	Identity string
+	// Tenants restricts the entries to these tenants when not empty
+	Tenants []string
+	Limit   int
+}
+
+func (f Filter) match(e *Entry) bool {
+	switch {
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && e.Time.After(f.Until):
+		return false
+	case f.Tenant != "" && e.Tenant != f.Tenant:
+		return false
+	case f.Identity != "" && e.Identity != f.Identity:
+		return false
+	case len(f.Tenants) > 0 && !slices.Contains(f.Tenants, e.Tenant):
+		return false
+	}
+	return true
+}
+
+// Log appends entries to a file, rotated to path.1 .. path.N when it would
+// grow past maxSize
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// Open opens the audit log at path for appending, keeping maxFiles rotated
+// files of at most maxSize bytes
+func Open(path string, maxSize int64, maxFiles int) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+
+	l := &Log{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.openLocked(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) openLocked() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends an entry. When the file is due for rotation but cannot be
+// rotated, the entry is still appended to it and the rotation error returned.
+func (l *Log) Write(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var rotateErr error
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		rotateErr = l.rotateLocked()
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return rotateErr
+}
+
+// rotateLocked shifts the rotated files, dropping the oldest, and starts a
+// new file. The current file stays open until the new one is, so that on
+// failure the log keeps appending to it. The caller must hold l.mu.
+func (l *Log) rotateLocked() error {
+	if l.maxFiles < 1 {
+		if err := l.file.Truncate(0); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+		l.size = 0
+		return nil
+	}
+
+	// A previous attempt that failed later on may have shifted them already
+	if _, err := os.Stat(l.rotated(1)); err == nil {
+		os.Remove(l.rotated(l.maxFiles))
+		for i := l.maxFiles - 1; i >= 1; i-- {
+			if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to rotate audit log: %w", err)
+			}
+		}
+	}
+	if err := os.Rename(l.path, l.rotated(1)); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+
+	old := l.file
+	if err := l.openLocked(); err != nil {
+		// Put the current file back in place and keep appending to it
+		if undoErr := os.Rename(l.rotated(1), l.path); undoErr != nil {
+			return fmt.Errorf("failed to rotate audit log: %w (and to restore it: %v)", err, undoErr)
+		}
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	if err := old.Close(); err != nil {
+		return fmt.Errorf("failed to close rotated audit log: %w", err)
+	}
+	return nil
+}
+
+func (l *Log) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// Close closes the audit log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Query returns the entries matching filter, newest first, at most
+// filter.Limit of them when it is positive
+func (l *Log) Query(filter Filter) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Oldest file first, so entries come out in write order
+	files := []string{l.path}
+	for i := 1; i <= l.maxFiles; i++ {
+		files = append([]string{l.rotated(i)}, files...)
+	}
+
+	entries := []Entry{}
+	for _, path := range files {
+		matches, err := readEntries(path, filter)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, matches...)
+	}
+
+	slices.Reverse(entries)
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
+
+// readEntries returns the entries of a log file matching filter. Lines that
+// cannot be parsed are skipped.
+func readEntries(path string, filter Filter) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if filter.match(&e) {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log %s: %w", path, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRotationFailureKeepsWriting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path, 200, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	entry := func(op string) Entry {
+		return Entry{Time: time.Now().UTC(), Operation: op, Method: "POST", Path: "/v1/tenants/provision", Status: 202}
+	}
+
+	if err := l.Write(entry("first")); err != nil {
+		t.Fatal(err)
+	}
+	// A non-empty directory in place of path.1 makes the rotation fail
+	blocker := filepath.Join(path+".1", "x")
+	if err := os.MkdirAll(blocker, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(entry("second")); err == nil {
+		t.Fatal("Write succeeded although the rotation failed")
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), `"second"`) {
+		t.Errorf("entry written during a failed rotation is missing:\n%s", data)
+	}
+
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(entry("third")); err != nil {
+		t.Fatalf("Write after the failure: %v", err)
+	}
+	rotated, _ := os.ReadFile(path + ".1")
+	current, _ := os.ReadFile(path)
+	if !strings.Contains(string(rotated), `"second"`) || !strings.Contains(string(current), `"third"`) {
+		t.Errorf("rotated = %s, current = %s", rotated, current)
+	}
+}
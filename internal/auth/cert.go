@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+// AuthenticateCert returns the token mapped to the subject, or common name,
+// of a verified client certificate. It returns nil when no token is mapped.
+func (s *Store) AuthenticateCert(cert *x509.Certificate, now time.Time) (*Token, error) {
+	subject := cert.Subject.String()
+	for _, t := range s.tokens {
+		if t.certSubject == "" || (t.certSubject != subject && t.certSubject != cert.Subject.CommonName) {
+			continue
+		}
+		if t.expired(now) {
+			return nil, ErrTokenExpired
+		}
+		return t, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// SignatureScheme is the Authorization scheme of signed requests:
+//
+//	Authorization: Q8-HMAC-SHA256 key=<token name>, timestamp=<unix seconds>, nonce=<nonce>, signature=<hex>
+//
+// The signature is the hex HMAC-SHA256, keyed with the hmac_secret of the
+// token, of StringToSign.
+const SignatureScheme = "Q8-HMAC-SHA256"
+
+// Mode selects the authentication schemes accepted by the agent
+type Mode string
+
+// Authentication modes
+const (
+	ModeBearer Mode = "bearer"
+	ModeHMAC   Mode = "hmac"
+	ModeAny    Mode = "any"
+)
+
+// DefaultMaxSkew bounds the difference between the timestamp of a signed
+// request and the agent clock
+const DefaultMaxSkew = 5 * time.Minute
+
+var noncePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+// Signed request errors
+var (
+	ErrBearerDisabled   = domain.NewError(domain.CodeUnauthorized, "bearer tokens are disabled, sign the request")
+	ErrHMACDisabled     = domain.NewError(domain.CodeUnauthorized, "signed requests are disabled")
+	ErrInvalidSignature = domain.NewError(domain.CodeUnauthorized, "invalid signature")
+	ErrStaleTimestamp   = domain.NewError(domain.CodeUnauthorized, "timestamp outside the allowed clock skew")
+	ErrReplayedNonce    = domain.NewError(domain.CodeUnauthorized, "nonce already used")
+)
+
+// ParseMode parses an authentication mode, bearer when s is empty
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case "":
+		return ModeBearer, nil
+	case ModeBearer, ModeHMAC, ModeAny:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid auth mode %q (bearer, hmac or any)", s)
+}
+
+// SignedRequest holds the signed parts of a request
+type SignedRequest struct {
+	Key       string
+	Timestamp int64
+	Nonce     string
+	Signature string
+
+	Method     string
+	RequestURI string
+	// BodySHA256 is the hex SHA-256 digest of the request body
+	BodySHA256 string
+}
+
+// ParseSignatureParams reads the key=value parameters following the scheme
+// in an Authorization header
+func ParseSignatureParams(params string) (*SignedRequest, error) {
+	req := &SignedRequest{}
+	for part := range strings.SplitSeq(params, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, domain.NewError(domain.CodeUnauthorized, "invalid signature parameters")
+		}
+		switch k {
+		case "key":
+			req.Key = v
+		case "timestamp":
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, domain.NewError(domain.CodeUnauthorized, "invalid signature timestamp")
+			}
+			req.Timestamp = ts
+		case "nonce":
+			req.Nonce = v
+		case "signature":
+			req.Signature = v
+		}
+	}
+
+	if req.Key == "" || req.Timestamp == 0 || req.Signature == "" {
+		return nil, domain.NewError(domain.CodeUnauthorized, "missing signature parameters (key, timestamp, nonce, signature)")
+	}
+	if !noncePattern.MatchString(req.Nonce) {
+		return nil, domain.NewError(domain.CodeUnauthorized, "nonce must be 16 to 128 letters, digits, underscores or hyphens")
+	}
+	return req, nil
+}
+
+// StringToSign returns the string covered by the signature of a request
+func (r *SignedRequest) StringToSign() string {
+	return strings.Join([]string{
+		SignatureScheme,
+		r.Method,
+		r.RequestURI,
+		strconv.FormatInt(r.Timestamp, 10),
+		r.Nonce,
+		r.BodySHA256,
+	}, "\n")
+}
+
+// Sign returns the hex signature of the request with secret
+func (r *SignedRequest) Sign(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(r.StringToSign()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Configure sets the accepted authentication schemes and the clock skew
+// allowed for signed requests. Signed modes need a token with an hmac_secret.
+func (s *Store) Configure(mode Mode, maxSkew time.Duration) error {
+	if mode != ModeBearer {
+		hasKey := false
+		for _, t := range s.tokens {
+			hasKey = hasKey || t.hmacKey != nil
+		}
+		if !hasKey {
+			return fmt.Errorf("auth mode %s needs a token with an hmac_secret in Q8_TOKENS_FILE", mode)
+		}
+	}
+	if mode == ModeHMAC {
+		for _, t := range s.tokens {
+			if t.bearer && t.hmacKey == nil {
+				return fmt.Errorf("auth mode hmac: token %q has no hmac_secret and cannot be used", t.Name)
+			}
+		}
+	}
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+
+	s.mode = mode
+	s.maxSkew = maxSkew
+	s.nonces = newNonceCache()
+	return nil
+}
+
+// Mode returns the accepted authentication schemes
+func (s *Store) Mode() Mode {
+	if s.mode == "" {
+		return ModeBearer
+	}
+	return s.mode
+}
+
+// AuthenticateSigned returns the token whose key signed req. The timestamp
+// must be within the allowed skew of now and the nonce must not have been
+// used by the key within that window.
+func (s *Store) AuthenticateSigned(req *SignedRequest, now time.Time) (*Token, error) {
+	if s.Mode() == ModeBearer {
+		return nil, ErrHMACDisabled
+	}
+
+	var key *Token
+	for _, t := range s.tokens {
+		if t.Name == req.Key && t.hmacKey != nil {
+			key = t
+		}
+	}
+	if key == nil {
+		return nil, ErrInvalidSignature
+	}
+
+	want := req.Sign(key.hmacKey)
+	if !hmac.Equal([]byte(want), []byte(strings.ToLower(req.Signature))) {
+		return nil, ErrInvalidSignature
+	}
+
+	ts := time.Unix(req.Timestamp, 0)
+	if ts.Before(now.Add(-s.maxSkew)) || ts.After(now.Add(s.maxSkew)) {
+		return nil, ErrStaleTimestamp
+	}
+	// A nonce only needs to be remembered while its timestamp is accepted
+	if !s.nonces.add(key.Name+"\n"+req.Nonce, ts.Add(s.maxSkew), now) {
+		return nil, ErrReplayedNonce
+	}
+
+	if key.expired(now) {
+		return nil, ErrTokenExpired
+	}
+	return key, nil
+}
+
+// nonceSweepInterval is how often expired nonces are dropped
+const nonceSweepInterval = time.Minute
+
+// nonceCache remembers the nonces of accepted signed requests until they
+// expire
+type nonceCache struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{nonces: make(map[string]time.Time)}
+}
+
+// add records nonce until expires. It reports false when the nonce is
+// already known.
+func (c *nonceCache) add(nonce string, expires, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) >= nonceSweepInterval {
+		for n, exp := range c.nonces {
+			if !now.Before(exp) {
+				delete(c.nonces, n)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if exp, ok := c.nonces[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	c.nonces[nonce] = expires
+	return true
+}
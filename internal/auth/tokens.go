@@ -0,0 +1,290 @@
+// Package auth holds the API tokens accepted by the agent and the
+// permissions they grant
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// Resources guarded by scopes
+const (
+	ResourceTenants    = "tenants"
+	ResourceDatabases  = "databases"
+	ResourceRegistries = "registries"
+	ResourceSystem     = "system"
+	ResourceAudit      = "audit"
+)
+
+// Scopes granted to tokens. A scope is a resource followed by read or write.
+const (
+	ScopeAll             = "*"
+	ScopeTenantsRead     = "tenants:read"
+	ScopeTenantsWrite    = "tenants:write"
+	ScopeDatabasesRead   = "databases:read"
+	ScopeDatabasesWrite  = "databases:write"
+	ScopeRegistriesRead  = "registries:read"
+	ScopeRegistriesWrite = "registries:write"
+	ScopeSystemRead      = "system:read"
+	ScopeAuditRead       = "audit:read"
+)
+
+var knownScopes = []string{
+	ScopeAll,
+	ScopeTenantsRead, ScopeTenantsWrite,
+	ScopeDatabasesRead, ScopeDatabasesWrite,
+	ScopeRegistriesRead, ScopeRegistriesWrite,
+	ScopeSystemRead, ScopeAuditRead,
+}
+
+// DefaultAdminToken is the placeholder admin token of older configurations,
+// which the agent refuses to run with
+const DefaultAdminToken = "change-me"
+
+// MinTokenLength is the minimum length of a token secret
+const MinTokenLength = 16
+
+// AdminTokenName names the token configured by Q8_AGENT_ADMIN_TOKEN
+const AdminTokenName = "admin"
+
+// Authentication errors
+var (
+	ErrInvalidToken = domain.NewError(domain.CodeUnauthorized, "invalid token")
+	ErrTokenExpired = domain.NewError(domain.CodeUnauthorized, "token expired")
+)
+
+// Token is a named API token, used as a bearer secret, as a request signing
+// key, or as the identity of a client certificate. Only the SHA-256 digest of
+// the bearer secret is kept once loaded.
+type Token struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Tenants   []string   `json:"tenants,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	bearer      bool
+	digest      [sha256.Size]byte
+	hmacKey     []byte
+	certSubject string
+}
+
+// HasScope reports whether the token grants scope
+func (t *Token) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, ScopeAll) || slices.Contains(t.Scopes, scope)
+}
+
+// AllowsTenant reports whether the token may act on a tenant. Tokens without
+// tenant restrictions may act on every tenant.
+func (t *Token) AllowsTenant(subdomain string) bool {
+	return len(t.Tenants) == 0 || slices.Contains(t.Tenants, subdomain)
+}
+
+// Restricted reports whether the token is limited to some tenants
+func (t *Token) Restricted() bool {
+	return len(t.Tenants) > 0
+}
+
+// tokenFileEntry is a token as written in the tokens file. The bearer secret
+// is given in clear or as the hex SHA-256 digest of the secret; hmac_secret
+// is the shared key of signed requests; cert_subject maps the verified client
+// certificates with this subject, or common name, to the token.
+type tokenFileEntry struct {
+	Token
+	Secret       string `json:"token,omitempty"`
+	SecretSHA256 string `json:"token_sha256,omitempty"`
+	HMACSecret   string `json:"hmac_secret,omitempty"`
+	CertSubject  string `json:"cert_subject,omitempty"`
+}
+
+// Store holds the tokens accepted by the agent
+type Store struct {
+	tokens []*Token
+
+	mode    Mode
+	maxSkew time.Duration
+	nonces  *nonceCache
+}
+
+// Load reads the tokens of the JSON file at path, a {"tokens": [...]} object,
+// when path is set, and adds adminToken with every scope when it is set. It
+// fails when no token is configured or when the admin token is still the
+// placeholder.
+func Load(path, adminToken string) (*Store, error) {
+	s := &Store{}
+	if path != "" {
+		if err := s.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if adminToken != "" {
+		if adminToken == DefaultAdminToken {
+			return nil, fmt.Errorf("Q8_AGENT_ADMIN_TOKEN is still the default %q, set a secret token or use Q8_TOKENS_FILE", DefaultAdminToken)
+		}
+		t := &Token{Name: AdminTokenName, Scopes: []string{ScopeAll}, bearer: true, digest: sha256.Sum256([]byte(adminToken))}
+		if err := s.add(t, adminToken); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.tokens) == 0 {
+		return nil, errors.New("no API token configured, set Q8_TOKENS_FILE or Q8_AGENT_ADMIN_TOKEN")
+	}
+	return s, nil
+}
+
+func (s *Store) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read tokens file: %w", err)
+	}
+
+	var file struct {
+		Tokens []tokenFileEntry `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse tokens file %s: %w", path, err)
+	}
+
+	for _, e := range file.Tokens {
+		t, err := e.token()
+		if err == nil {
+			err = s.add(t, e.Secret)
+		}
+		if err != nil {
+			return fmt.Errorf("tokens file %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// token returns the token of the entry with the digest of its secret
+func (e *tokenFileEntry) token() (*Token, error) {
+	t := e.Token
+	switch {
+	case e.Secret != "" && e.SecretSHA256 != "":
+		return nil, fmt.Errorf("token %q: set only one of token and token_sha256", t.Name)
+	case e.Secret != "":
+		t.digest = sha256.Sum256([]byte(e.Secret))
+		t.bearer = true
+	case e.SecretSHA256 != "":
+		digest, err := hex.DecodeString(e.SecretSHA256)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("token %q: token_sha256 must be a hex SHA-256 digest", t.Name)
+		}
+		copy(t.digest[:], digest)
+		t.bearer = true
+	case e.HMACSecret == "" && e.CertSubject == "":
+		return nil, fmt.Errorf("token %q: missing token, token_sha256, hmac_secret or cert_subject", t.Name)
+	}
+	if e.HMACSecret != "" {
+		t.hmacKey = []byte(e.HMACSecret)
+	}
+	t.certSubject = e.CertSubject
+	return &t, nil
+}
+
+// add validates t, whose clear secret is empty when only its digest is
+// known, and adds it to the store
+func (s *Store) add(t *Token, secret string) error {
+	if t.Name == "" {
+		return errors.New("token without a name")
+	}
+	if secret != "" {
+		if secret == DefaultAdminToken {
+			return fmt.Errorf("token %q: the default token %q is not allowed", t.Name, DefaultAdminToken)
+		}
+		if len(secret) < MinTokenLength {
+			return fmt.Errorf("token %q: must be at least %d characters", t.Name, MinTokenLength)
+		}
+	}
+	if t.hmacKey != nil && len(t.hmacKey) < MinTokenLength {
+		return fmt.Errorf("token %q: hmac_secret must be at least %d characters", t.Name, MinTokenLength)
+	}
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("token %q: no scopes", t.Name)
+	}
+	for _, scope := range t.Scopes {
+		if !slices.Contains(knownScopes, scope) {
+			return fmt.Errorf("token %q: unknown scope %q (valid: %s)", t.Name, scope, strings.Join(knownScopes, ", "))
+		}
+	}
+	for _, sub := range t.Tenants {
+		if err := domain.ValidateSubdomain(sub); err != nil {
+			return fmt.Errorf("token %q: %w", t.Name, err)
+		}
+	}
+
+	for _, other := range s.tokens {
+		if other.Name == t.Name {
+			return fmt.Errorf("duplicate token name %q", t.Name)
+		}
+		if other.bearer && t.bearer && other.digest == t.digest {
+			return fmt.Errorf("tokens %q and %q share the same secret", other.Name, t.Name)
+		}
+		if other.certSubject != "" && other.certSubject == t.certSubject {
+			return fmt.Errorf("tokens %q and %q share the same cert_subject", other.Name, t.Name)
+		}
+	}
+	s.tokens = append(s.tokens, t)
+	return nil
+}
+
+// Len returns the number of tokens
+func (s *Store) Len() int {
+	return len(s.tokens)
+}
+
+// Authenticate returns the token whose secret is secret. Every token is
+// compared, in constant time, so the answer does not depend on which token
+// matched or how much of it did.
+func (s *Store) Authenticate(secret string, now time.Time) (*Token, error) {
+	if s.Mode() == ModeHMAC {
+		return nil, ErrBearerDisabled
+	}
+
+	digest := sha256.Sum256([]byte(secret))
+	var match *Token
+	for _, t := range s.tokens {
+		if t.bearer && subtle.ConstantTimeCompare(digest[:], t.digest[:]) == 1 {
+			match = t
+		}
+	}
+
+	if match == nil {
+		return nil, ErrInvalidToken
+	}
+	if match.expired(now) {
+		return nil, ErrTokenExpired
+	}
+	return match, nil
+}
+
+func (t *Token) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// tokenKey is the context key of the authenticated token
+type tokenKey struct{}
+
+// WithToken returns a copy of ctx carrying the authenticated token
+func WithToken(ctx context.Context, t *Token) context.Context {
+	return context.WithValue(ctx, tokenKey{}, t)
+}
+
+// FromContext returns the authenticated token carried by ctx, if any
+func FromContext(ctx context.Context) *Token {
+	t, _ := ctx.Value(tokenKey{}).(*Token)
+	return t
+}
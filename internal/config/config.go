@@ -1,30 +1,97 @@
 package config
 
 import (
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 // Config holds the agent configuration
 type Config struct {
 	Port          string
 	AdminToken    string
+	TokensFile    string
+	AuthMode      string
+	HMACMaxSkew   time.Duration
 	TenantsRoot   string
+	StateDir      string
+	DockerSocket  string
 	MongoHost     string
 	MongoPort     string
 	MongoUser     string
 	MongoPassword string
+	JobWorkers    int
+	JobQueueSize  int
+	JobRetention  time.Duration
+	LockMode      string
+
+	ArchiveRetention       time.Duration
+	ArchiveJanitorInterval time.Duration
+
+	RegistryAuthFile string
+	RegistryHost     string
+	RegistryUser     string
+	RegistryPassword string
+
+	MasterKey        string
+	MasterKeyFile    string
+	OldMasterKey     string
+	OldMasterKeyFile string
+
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	AuditLog      string
+	AuditMaxSize  int
+	AuditMaxFiles int
 }
 
 // LoadConfig loads configuration from environment variables
 func LoadConfig() *Config {
+	tenantsRoot := getEnv("Q8_TENANTS_ROOT", "/opt/tenants")
+	stateDir := getEnv("Q8_STATE_DIR", filepath.Join(tenantsRoot, ".q8-agent"))
+
 	return &Config{
 		Port:          getEnv("Q8_AGENT_PORT", "8080"),
-		AdminToken:    getEnv("Q8_AGENT_ADMIN_TOKEN", "change-me"),
-		TenantsRoot:   getEnv("Q8_TENANTS_ROOT", "/opt/tenants"),
+		AdminToken:    getEnv("Q8_AGENT_ADMIN_TOKEN", ""),
+		TokensFile:    getEnv("Q8_TOKENS_FILE", ""),
+		AuthMode:      getEnv("Q8_AUTH_MODE", "bearer"),
+		HMACMaxSkew:   getEnvDuration("Q8_HMAC_MAX_SKEW", 5*time.Minute),
+		TenantsRoot:   tenantsRoot,
+		StateDir:      stateDir,
+		DockerSocket:  getEnv("Q8_DOCKER_SOCKET", "/var/run/docker.sock"),
 		MongoHost:     getEnv("Q8_MONGO_HOST", "127.0.0.1"),
 		MongoPort:     getEnv("Q8_MONGO_PORT", "27017"),
 		MongoUser:     getEnv("Q8_MONGO_USER", "admin"),
 		MongoPassword: getEnv("Q8_MONGO_PASSWORD", ""),
+		JobWorkers:    getEnvInt("Q8_JOB_WORKERS", 4),
+		JobQueueSize:  getEnvInt("Q8_JOB_QUEUE_SIZE", 100),
+		JobRetention:  getEnvDuration("Q8_JOB_RETENTION", time.Hour),
+		LockMode:      getEnv("Q8_LOCK_MODE", "reject"),
+
+		ArchiveRetention:       getEnvDuration("Q8_ARCHIVE_RETENTION", 0),
+		ArchiveJanitorInterval: getEnvDuration("Q8_ARCHIVE_JANITOR_INTERVAL", time.Hour),
+
+		RegistryAuthFile: getEnv("Q8_REGISTRY_AUTH_FILE", ""),
+		RegistryHost:     getEnv("Q8_REGISTRY_HOST", ""),
+		RegistryUser:     getEnv("Q8_REGISTRY_USER", ""),
+		RegistryPassword: getEnv("Q8_REGISTRY_PASSWORD", ""),
+
+		MasterKey:        getEnv("Q8_MASTER_KEY", ""),
+		MasterKeyFile:    getEnv("Q8_MASTER_KEY_FILE", ""),
+		OldMasterKey:     getEnv("Q8_OLD_MASTER_KEY", ""),
+		OldMasterKeyFile: getEnv("Q8_OLD_MASTER_KEY_FILE", ""),
+
+		TLSCertFile:     getEnv("Q8_TLS_CERT_FILE", ""),
+		TLSKeyFile:      getEnv("Q8_TLS_KEY_FILE", ""),
+		TLSClientCAFile: getEnv("Q8_TLS_CLIENT_CA_FILE", ""),
+
+		AuditLog:      getEnv("Q8_AUDIT_LOG", filepath.Join(stateDir, "audit.log")),
+		AuditMaxSize:  getEnvInt("Q8_AUDIT_MAX_SIZE", 10<<20),
+		AuditMaxFiles: getEnvInt("Q8_AUDIT_MAX_FILES", 5),
 	}
 }
 
@@ -34,3 +101,29 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid integer for %s (%q), using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: invalid duration for %s (%q), using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,282 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qate/q8-agent/internal/metrics"
+)
+
+// DefaultSocket is the default location of the Docker Engine socket
+const DefaultSocket = "/var/run/docker.sock"
+
+// Compose labels attached by docker compose to the resources it creates
+const (
+	LabelProject         = "com.docker.compose.project"
+	LabelService         = "com.docker.compose.service"
+	LabelContainerNumber = "com.docker.compose.container-number"
+	LabelVolume          = "com.docker.compose.volume"
+)
+
+// APIError is returned when the Docker Engine answers with a non-2xx status
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("docker engine: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// ErrUnreachable is wrapped by errors of requests that never reached the engine
+var ErrUnreachable = errors.New("docker engine unreachable")
+
+// IsUnreachable reports whether err means the Docker Engine could not be reached
+func IsUnreachable(err error) bool {
+	return errors.Is(err, ErrUnreachable)
+}
+
+// IsNotFound reports whether err is a 404 answer from the Docker Engine
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Client talks to the Docker Engine HTTP API over a unix socket
+type Client struct {
+	http *http.Client
+
+	failures *metrics.Counter
+}
+
+// NewClient creates a new Docker Engine API client for the given socket path
+func NewClient(socketPath string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+		MaxIdleConns:    10,
+		IdleConnTimeout: 30 * time.Second,
+	}
+	return &Client{http: &http.Client{Transport: transport}}
+}
+
+// Ping checks that the Docker Engine is reachable
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/_ping", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListContainers returns all containers (running or not) carrying the given labels
+func (c *Client) ListContainers(ctx context.Context, labels ...string) ([]Container, error) {
+	query := url.Values{}
+	query.Set("all", "1")
+	if len(labels) > 0 {
+		filters, err := json.Marshal(map[string][]string{"label": labels})
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", string(filters))
+	}
+
+	var containers []Container
+	if err := c.getJSON(ctx, "/containers/json", query, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// InspectContainer returns low-level information about a container
+func (c *Client) InspectContainer(ctx context.Context, id string) (*ContainerDetails, error) {
+	var details ContainerDetails
+	if err := c.getJSON(ctx, "/containers/"+url.PathEscape(id)+"/json", nil, &details); err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+// RestartContainer restarts a container, waiting up to timeout for it to stop
+func (c *Client) RestartContainer(ctx context.Context, id string, timeout time.Duration) error {
+	query := url.Values{}
+	query.Set("t", strconv.Itoa(int(timeout.Seconds())))
+	resp, err := c.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/restart", query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// StopContainer stops a container, waiting up to timeout before killing it.
+// Stopping a stopped container is not an error.
+func (c *Client) StopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	query := url.Values{}
+	query.Set("t", strconv.Itoa(int(timeout.Seconds())))
+	return c.post(ctx, "/containers/"+url.PathEscape(id)+"/stop", query)
+}
+
+// StartContainer starts a stopped container. Starting a running container is
+// not an error.
+func (c *Client) StartContainer(ctx context.Context, id string) error {
+	return c.post(ctx, "/containers/"+url.PathEscape(id)+"/start", nil)
+}
+
+// ContainerLogs opens the raw log stream of a container. The caller must close it.
+// Unless the container has a TTY the stream is multiplexed, see DemuxLogs.
+func (c *Client) ContainerLogs(ctx context.Context, id string, opts LogsOptions) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	if opts.Tail > 0 {
+		query.Set("tail", strconv.Itoa(opts.Tail))
+	} else {
+		query.Set("tail", "all")
+	}
+	if opts.Follow {
+		query.Set("follow", "1")
+	}
+	if opts.Timestamps {
+		query.Set("timestamps", "1")
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", strconv.FormatInt(opts.Since.Unix(), 10))
+	}
+	if !opts.Until.IsZero() {
+		query.Set("until", strconv.FormatInt(opts.Until.Unix(), 10))
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/containers/"+url.PathEscape(id)+"/logs", query)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ListVolumes returns the volumes matching every given label filter
+func (c *Client) ListVolumes(ctx context.Context, labels ...string) ([]Volume, error) {
+	query := url.Values{}
+	if len(labels) > 0 {
+		filters, err := json.Marshal(map[string][]string{"label": labels})
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", string(filters))
+	}
+
+	var body struct {
+		Volumes []Volume `json:"Volumes"`
+	}
+	if err := c.getJSON(ctx, "/volumes", query, &body); err != nil {
+		return nil, err
+	}
+	return body.Volumes, nil
+}
+
+// RemoveVolume removes a volume. Removing a missing volume is not an error.
+func (c *Client) RemoveVolume(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/volumes/"+url.PathEscape(name), nil)
+	if IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// InspectImage returns low-level information about an image
+func (c *Client) InspectImage(ctx context.Context, ref string) (*ImageDetails, error) {
+	var details ImageDetails
+	if err := c.getJSON(ctx, "/images/"+ref+"/json", nil, &details); err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+// getJSON performs a GET request and decodes the JSON answer into out
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, out any) error {
+	resp, err := c.do(ctx, http.MethodGet, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("docker engine: failed to decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// post sends a POST request without a body, treating 304 Not Modified, which
+// the engine answers when the container is already in the requested state, as
+// success
+func (c *Client) post(ctx context.Context, path string, query url.Values) error {
+	resp, err := c.do(ctx, http.MethodPost, path, query)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a request to the engine and converts non-2xx answers into an APIError
+func (c *Client) do(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		// Requests abandoned by the caller are not engine failures
+		if ctx.Err() == nil {
+			c.failed(path)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			c.failed(path)
+		}
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err == nil && body.Message != "" {
+			apiErr.Message = body.Message
+		} else {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, apiErr
+	}
+
+	return resp, nil
+}
+
+// failed counts a failed request, by endpoint: the first element of its path
+func (c *Client) failed(path string) {
+	endpoint, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	c.failures.Inc("engine", endpoint)
+}
@@ -0,0 +1,193 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newFakeEngine serves handler on a unix socket and returns a client for it
+func newFakeEngine(t *testing.T, handler http.Handler) *Client {
+	t.Helper()
+
+	// Socket paths are limited to about 100 bytes, shorter than most t.TempDir paths
+	dir, err := os.MkdirTemp("", "q8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return NewClient(socket)
+}
+
+func writeEngineJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// logFrame returns a multiplexed log frame of the given stream
+func logFrame(stream byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestClientListContainers(t *testing.T) {
+	var gotQuery map[string][]string
+	c := newFakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("all") != "1" {
+			t.Errorf("all = %q, want 1", r.URL.Query().Get("all"))
+		}
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &gotQuery)
+		writeEngineJSON(w, http.StatusOK, []Container{{
+			ID:     "abc",
+			Names:  []string{"/q8-acme-web-1"},
+			State:  "running",
+			Labels: map[string]string{LabelProject: "q8-acme", LabelService: "web"},
+		}})
+	}))
+
+	containers, err := c.ListContainers(context.Background(), LabelProject+"=q8-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 {
+		t.Fatalf("got %d containers, want 1", len(containers))
+	}
+	if got := containers[0]; got.Name() != "q8-acme-web-1" || got.Service() != "web" || got.State != "running" {
+		t.Errorf("container = %s/%s/%s, want q8-acme-web-1/web/running", got.Name(), got.Service(), got.State)
+	}
+	if labels := gotQuery["label"]; len(labels) != 1 || labels[0] != LabelProject+"=q8-acme" {
+		t.Errorf("label filter = %v", labels)
+	}
+}
+
+func TestClientInspectContainer(t *testing.T) {
+	c := newFakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/abc/json":
+			writeEngineJSON(w, http.StatusOK, ContainerDetails{
+				ID:           "abc",
+				RestartCount: 2,
+				State:        ContainerState{Running: true, StartedAt: "2024-01-01T00:00:00Z"},
+				Config:       ContainerConfig{Image: "nginx:latest", Tty: true},
+			})
+		default:
+			writeEngineJSON(w, http.StatusNotFound, map[string]string{"message": "No such container: missing"})
+		}
+	}))
+
+	details, err := c.InspectContainer(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !details.State.Running || details.RestartCount != 2 || details.Config.Image != "nginx:latest" || !details.Config.Tty {
+		t.Errorf("details = %+v", details)
+	}
+
+	_, err = c.InspectContainer(context.Background(), "missing")
+	if !IsNotFound(err) {
+		t.Fatalf("err = %v, want a not found error", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Message != "No such container: missing" {
+		t.Errorf("err = %v, want the engine message", err)
+	}
+}
+
+func TestClientContainerLogs(t *testing.T) {
+	c := newFakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/abc/logs" {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("tail") != "10" || q.Get("timestamps") != "1" || q.Get("stdout") != "1" || q.Get("stderr") != "1" {
+			t.Errorf("query = %s", r.URL.RawQuery)
+		}
+		w.Write(logFrame(1, "out line\n"))
+		w.Write(logFrame(2, "err line\n"))
+	}))
+
+	stream, err := c.ContainerLogs(context.Background(), "abc", LogsOptions{Tail: 10, Timestamps: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	var out bytes.Buffer
+	if err := DemuxLogs(&out, stream); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "out line\nerr line\n"; got != want {
+		t.Errorf("logs = %q, want %q", got, want)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	c := newFakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/volumes/missing":
+			writeEngineJSON(w, http.StatusNotFound, map[string]string{"message": "no such volume"})
+		case "/containers/running/start":
+			w.WriteHeader(http.StatusNotModified)
+		case "/containers/broken/restart":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	ctx := context.Background()
+
+	if err := c.RemoveVolume(ctx, "missing"); err != nil {
+		t.Errorf("RemoveVolume of a missing volume: %v", err)
+	}
+	if err := c.StartContainer(ctx, "running"); err != nil {
+		t.Errorf("StartContainer of a running container: %v", err)
+	}
+
+	err := c.RestartContainer(ctx, "broken", stopTimeout)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError || IsNotFound(err) {
+		t.Fatalf("err = %v, want a 500 APIError", err)
+	}
+	if apiErr.Message != http.StatusText(http.StatusInternalServerError) {
+		t.Errorf("message = %q, want the status text when the body has none", apiErr.Message)
+	}
+}
+
+func TestClientUnreachable(t *testing.T) {
+	c := NewClient(filepath.Join(t.TempDir(), "missing.sock"))
+
+	err := c.Ping(context.Background())
+	if !IsUnreachable(err) {
+		t.Fatalf("err = %v, want an unreachable error", err)
+	}
+	if IsNotFound(err) {
+		t.Errorf("unreachable error reported as not found")
+	}
+}
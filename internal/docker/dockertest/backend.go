@@ -0,0 +1,500 @@
+// Package dockertest provides an in-memory compose backend for exercising the
+// orchestration logic without a Docker daemon.
+package dockertest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/qate/q8-agent/internal/docker"
+	"github.com/qate/q8-agent/internal/service"
+)
+
+var _ service.ComposeBackend = (*Backend)(nil)
+
+// Call records a single invocation of the backend
+type Call struct {
+	Method  string
+	Project string
+	Dir     string
+}
+
+// Project is the in-memory state of a compose project
+type Project struct {
+	Dir        string
+	Running    bool
+	Services   []string
+	Restarts   int
+	Containers []docker.ServiceContainer
+	// ImageIDs maps each service to the ID of the image its container runs
+	ImageIDs map[string]string
+}
+
+// MongoScript records a mongo script execution
+type MongoScript struct {
+	Script string
+	Env    map[string]string
+}
+
+// Backend is an in-memory implementation of the orchestrator compose backend.
+// It is safe for concurrent use.
+type Backend struct {
+	mu       sync.Mutex
+	projects map[string]*Project
+	services map[string][]string
+	volumes  map[string][]string
+	failures map[string]error
+	images   map[string]string
+	calls    []Call
+	scripts  []MongoScript
+	mongoOut string
+}
+
+// NewBackend creates an empty fake backend
+func NewBackend() *Backend {
+	return &Backend{
+		projects: make(map[string]*Project),
+		services: make(map[string][]string),
+		volumes:  make(map[string][]string),
+		failures: make(map[string]error),
+		images:   make(map[string]string),
+	}
+}
+
+// SetImageID makes ref resolve to id, as if a pull had fetched a new image.
+// Unknown references resolve to "sha256:" followed by the reference.
+func (b *Backend) SetImageID(ref, id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.images[ref] = id
+}
+
+// SetMongoOutput sets the output of the next mongo scripts. It defaults to "ok".
+func (b *Backend) SetMongoOutput(out string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mongoOut = out
+}
+
+// SetServices sets the services created by the next up of project.
+// Projects without explicit services get a single "app" service.
+func (b *Backend) SetServices(project string, services ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.services[project] = slices.Clone(services)
+}
+
+// SetVolumes sets the volumes of project. Like real volumes they survive
+// ExecuteComposeDown until removed.
+func (b *Backend) SetVolumes(project string, volumes ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.volumes[project] = slices.Clone(volumes)
+}
+
+// SetContainerState sets the state of a container of project, as if it had
+// stopped on its own
+func (b *Backend) SetContainerState(project, name, state string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p, ok := b.projects[project]; ok {
+		for i := range p.Containers {
+			if p.Containers[i].Name == name {
+				p.Containers[i].State = state
+			}
+		}
+	}
+}
+
+// FailOn makes every subsequent call to method return err. A nil err clears it.
+func (b *Backend) FailOn(method string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.failures, method)
+		return
+	}
+	b.failures[method] = err
+}
+
+// Project returns a copy of the state of project, if it exists
+func (b *Backend) Project(project string) (Project, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.projects[project]
+	if !ok {
+		return Project{}, false
+	}
+	cp := *p
+	cp.Services = slices.Clone(p.Services)
+	cp.Containers = slices.Clone(p.Containers)
+	cp.ImageIDs = maps.Clone(p.ImageIDs)
+	return cp, true
+}
+
+// Calls returns every call made to the backend, in order
+func (b *Backend) Calls() []Call {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.calls)
+}
+
+// Scripts returns every mongo script executed, in order
+func (b *Backend) Scripts() []MongoScript {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.scripts)
+}
+
+// ExecuteComposeUp creates and starts the containers of project
+func (b *Backend) ExecuteComposeUp(_ context.Context, project, dir string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ExecuteComposeUp", project, dir); err != nil {
+		return []byte(err.Error()), err
+	}
+	return b.upLocked(project, dir), nil
+}
+
+// upLocked starts the containers of project. The caller must hold b.mu.
+func (b *Backend) upLocked(project, dir string) []byte {
+	services := b.services[project]
+	if len(services) == 0 {
+		services = []string{"app"}
+	}
+
+	p := &Project{Dir: dir, Running: true, Services: services, ImageIDs: make(map[string]string)}
+	for _, svc := range services {
+		name := fmt.Sprintf("%s-%s-1", project, svc)
+		image := svc + ":latest"
+		p.Containers = append(p.Containers, docker.ServiceContainer{
+			ID:      name,
+			Name:    name,
+			Service: svc,
+			Image:   image,
+			State:   "running",
+			Status:  "Up",
+		})
+		p.ImageIDs[svc] = b.imageIDLocked(image)
+	}
+	b.projects[project] = p
+
+	return []byte("started " + project + "\n")
+}
+
+// ExecuteComposeUpCached behaves like ExecuteComposeUp without pulling
+func (b *Backend) ExecuteComposeUpCached(_ context.Context, project, dir string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ExecuteComposeUpCached", project, dir); err != nil {
+		return []byte(err.Error()), err
+	}
+	return b.upLocked(project, dir), nil
+}
+
+// ExecuteComposeUpServices recreates the given services with their current image
+func (b *Backend) ExecuteComposeUpServices(_ context.Context, project, dir string, services []string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ExecuteComposeUpServices", project, dir); err != nil {
+		return []byte(err.Error()), err
+	}
+
+	p, ok := b.projects[project]
+	if !ok {
+		return nil, fmt.Errorf("no such project: %s", project)
+	}
+	for _, svc := range services {
+		for _, c := range p.Containers {
+			if c.Service == svc {
+				p.ImageIDs[svc] = b.imageIDLocked(c.Image)
+			}
+		}
+	}
+	return []byte(fmt.Sprintf("recreated %v\n", services)), nil
+}
+
+// ExecuteComposeDown removes the containers of project
+func (b *Backend) ExecuteComposeDown(_ context.Context, project, dir string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ExecuteComposeDown", project, dir); err != nil {
+		return []byte(err.Error()), err
+	}
+
+	delete(b.projects, project)
+	return []byte("removed " + project + "\n"), nil
+}
+
+// ExecuteComposePull records a pull of project
+func (b *Backend) ExecuteComposePull(_ context.Context, project, dir string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ExecuteComposePull", project, dir); err != nil {
+		return []byte(err.Error()), err
+	}
+	return []byte("pulled " + project + "\n"), nil
+}
+
+// ComposeRestart restarts the containers of project, restricted to services
+// when any are given
+func (b *Backend) ComposeRestart(_ context.Context, project string, services ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ComposeRestart", project, ""); err != nil {
+		return err
+	}
+
+	p, ok := b.projects[project]
+	if !ok {
+		return nil // Like the engine, restarting nothing is not an error
+	}
+	p.Restarts++
+	for i := range p.Containers {
+		if len(services) > 0 && !slices.Contains(services, p.Containers[i].Service) {
+			continue
+		}
+		p.Containers[i].RestartCount++
+		p.Containers[i].State = "running"
+	}
+	return nil
+}
+
+// ComposeStop stops the running containers of project and returns their names
+func (b *Backend) ComposeStop(_ context.Context, project string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ComposeStop", project, ""); err != nil {
+		return nil, err
+	}
+
+	p, ok := b.projects[project]
+	if !ok || len(p.Containers) == 0 {
+		return nil, fmt.Errorf("%s: %w", project, docker.ErrNoContainers)
+	}
+	stopped := []string{}
+	for i, c := range p.Containers {
+		if c.State == "running" {
+			p.Containers[i].State = "exited"
+			p.Containers[i].Status = "Exited (0)"
+			stopped = append(stopped, c.Name)
+		}
+	}
+	return stopped, nil
+}
+
+// ComposeStart starts the named containers of project
+func (b *Backend) ComposeStart(_ context.Context, project string, names []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ComposeStart", project, ""); err != nil {
+		return err
+	}
+
+	p, ok := b.projects[project]
+	if !ok || len(p.Containers) == 0 {
+		return fmt.Errorf("%s: %w", project, docker.ErrNoContainers)
+	}
+	for i, c := range p.Containers {
+		if slices.Contains(names, c.Name) {
+			p.Containers[i].State = "running"
+			p.Containers[i].Status = "Up"
+		}
+	}
+	return nil
+}
+
+// ComposeVolumes returns the volumes of project, sorted
+func (b *Backend) ComposeVolumes(_ context.Context, project string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ComposeVolumes", project, ""); err != nil {
+		return nil, err
+	}
+
+	volumes := slices.Clone(b.volumes[project])
+	slices.Sort(volumes)
+	return volumes, nil
+}
+
+// RemoveVolume removes a volume from whichever project holds it
+func (b *Backend) RemoveVolume(_ context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("RemoveVolume", name, ""); err != nil {
+		return err
+	}
+
+	for project, volumes := range b.volumes {
+		b.volumes[project] = slices.DeleteFunc(volumes, func(v string) bool { return v == name })
+	}
+	return nil
+}
+
+// BackupVolume writes a fake archive of volume to dst
+func (b *Backend) BackupVolume(_ context.Context, volume string, dst io.Writer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("BackupVolume", volume, ""); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(dst, "backup of %s\n", volume)
+	return err
+}
+
+// RestoreVolume creates volume in project, ignoring the archive content
+func (b *Backend) RestoreVolume(_ context.Context, project, volume string, src io.Reader) error {
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("RestoreVolume", project, volume); err != nil {
+		return err
+	}
+	if !slices.Contains(b.volumes[project], volume) {
+		b.volumes[project] = append(b.volumes[project], volume)
+	}
+	return nil
+}
+
+// ComposePs returns the containers of project
+func (b *Backend) ComposePs(_ context.Context, project string) ([]docker.ServiceContainer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ComposePs", project, ""); err != nil {
+		return nil, err
+	}
+
+	p, ok := b.projects[project]
+	if !ok {
+		return []docker.ServiceContainer{}, nil
+	}
+	return append([]docker.ServiceContainer(nil), p.Containers...), nil
+}
+
+// ComposeServices returns the services of the containers of project, sorted
+func (b *Backend) ComposeServices(_ context.Context, project string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ComposeServices", project, ""); err != nil {
+		return nil, err
+	}
+
+	var services []string
+	if p, ok := b.projects[project]; ok {
+		for _, c := range p.Containers {
+			if !slices.Contains(services, c.Service) {
+				services = append(services, c.Service)
+			}
+		}
+	}
+	slices.Sort(services)
+	return services, nil
+}
+
+// ComposeLogs writes one fake log line per selected container of project.
+// When following, it then blocks until ctx is done.
+func (b *Backend) ComposeLogs(ctx context.Context, project string, opts docker.ComposeLogsOptions, dst io.Writer) error {
+	// The lock is released before following, which lasts until ctx is done
+	b.mu.Lock()
+	out, err := b.logsLocked(project, opts.Services)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if _, err := dst.Write(out); err != nil {
+		return err
+	}
+	if opts.Follow {
+		<-ctx.Done()
+	}
+	return nil
+}
+
+// logsLocked records a logs call and returns the log lines of the selected
+// containers of project. The caller must hold b.mu.
+func (b *Backend) logsLocked(project string, services []string) ([]byte, error) {
+	if err := b.recordLocked("ComposeLogs", project, ""); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	if p, ok := b.projects[project]; ok {
+		for _, c := range p.Containers {
+			if len(services) == 0 || slices.Contains(services, c.Service) {
+				out = append(out, fmt.Sprintf("%s  | started\n", c.Name)...)
+			}
+		}
+	}
+	return out, nil
+}
+
+// ComposeImages returns the images of the containers of project
+func (b *Backend) ComposeImages(_ context.Context, project string) ([]docker.ServiceImage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ComposeImages", project, ""); err != nil {
+		return nil, err
+	}
+
+	images := []docker.ServiceImage{}
+	if p, ok := b.projects[project]; ok {
+		for _, c := range p.Containers {
+			images = append(images, docker.ServiceImage{
+				Service:   c.Service,
+				Container: c.Name,
+				Image:     c.Image,
+				ImageID:   p.ImageIDs[c.Service],
+				RepoTags:  []string{c.Image},
+			})
+		}
+	}
+	return images, nil
+}
+
+// ImageID resolves ref to the image ID set with SetImageID
+func (b *Backend) ImageID(_ context.Context, ref string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ImageID", ref, ""); err != nil {
+		return "", err
+	}
+	return b.imageIDLocked(ref), nil
+}
+
+// ExecuteMongoScript records the script and its environment
+func (b *Backend) ExecuteMongoScript(_ context.Context, host, script string, env map[string]string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recordLocked("ExecuteMongoScript", host, ""); err != nil {
+		return []byte(err.Error()), err
+	}
+	b.scripts = append(b.scripts, MongoScript{Script: script, Env: maps.Clone(env)})
+	if b.mongoOut != "" {
+		return []byte(b.mongoOut), nil
+	}
+	return []byte("ok"), nil
+}
+
+// imageIDLocked resolves ref. The caller must hold b.mu.
+func (b *Backend) imageIDLocked(ref string) string {
+	if id, ok := b.images[ref]; ok {
+		return id
+	}
+	return "sha256:" + ref
+}
+
+// recordLocked appends a call and returns the configured failure for method, if any.
+// The caller must hold b.mu.
+func (b *Backend) recordLocked(method, project, dir string) error {
+	b.calls = append(b.calls, Call{Method: method, Project: project, Dir: dir})
+	return b.failures[method]
+}
@@ -1,66 +1,386 @@
 package docker
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qate/q8-agent/internal/metrics"
 )
 
-// Runner handles docker operations
-type Runner struct{}
+// daemonDownMarker is printed by the docker CLI when the daemon cannot be reached
+const daemonDownMarker = "Cannot connect to the Docker daemon"
+
+// IsDaemonDown reports whether docker CLI output shows the daemon was unreachable
+func IsDaemonDown(out []byte) bool {
+	return bytes.Contains(out, []byte(daemonDownMarker))
+}
+
+// mongoEnvPrefix starts the names of the agent mongo settings, left out of the
+// environment of mongo scripts
+const mongoEnvPrefix = "Q8_MONGO_"
+
+// backupImage runs tar to export volume contents
+const backupImage = "alpine:3"
+
+// stopTimeout is how long the engine waits for a container to stop on restart
+// or stop before killing it
+const stopTimeout = 10 * time.Second
+
+// ErrNoContainers is returned when stopping or starting a compose project
+// that has no containers
+var ErrNoContainers = errors.New("compose project has no containers")
+
+// AuthProvider prepares a docker config directory with registry logins. The
+// returned path is empty when there is nothing to authenticate with.
+type AuthProvider interface {
+	DockerConfig() (dir string, cleanup func(), err error)
+}
+
+// Runner handles docker operations. Stack lifecycle (up, down, pull) goes
+// through the docker compose CLI, everything else through the Engine API.
+type Runner struct {
+	engine *Client
+	auth   AuthProvider
+
+	failures *metrics.Counter
+}
+
+// NewRunner creates a new docker runner backed by the given engine client.
+// When auth is not nil, commands that pull images run with its docker config.
+func NewRunner(engine *Client, auth AuthProvider) *Runner {
+	return &Runner{engine: engine, auth: auth}
+}
 
-// NewRunner creates a new docker runner
-func NewRunner() *Runner {
-	return &Runner{}
+// Instrument counts in reg the docker CLI commands that fail and the Engine
+// API requests that fail to reach the engine or get a server error
+func (r *Runner) Instrument(reg *metrics.Registry) {
+	r.failures = reg.Counter("q8_docker_failures_total",
+		"Failed docker CLI commands (interface cli) and Engine API requests (interface engine), by command or endpoint", "interface", "command")
+	r.engine.failures = r.failures
 }
 
 // ExecuteComposeUp runs docker compose up
-func (r *Runner) ExecuteComposeUp(project, dir string) ([]byte, error) {
-	cmd := exec.Command("docker", "compose", "-p", project, "up", "-d", "--pull", "always", "--force-recreate")
+func (r *Runner) ExecuteComposeUp(ctx context.Context, project, dir string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "docker", "compose", "-p", project, "up", "-d", "--pull", "always", "--force-recreate")
 	cmd.Dir = dir
-	return cmd.CombinedOutput()
+	return r.runWithAuth(cmd)
 }
 
-// ExecuteComposeDown runs docker compose down
-func (r *Runner) ExecuteComposeDown(project, dir string) ([]byte, error) {
-	cmd := exec.Command("docker", "compose", "-p", project, "down", "-v", "--remove-orphans")
+// ExecuteComposeUpCached runs docker compose up with the images already present
+// locally, pulling only missing ones. Used to bring back a previous configuration.
+func (r *Runner) ExecuteComposeUpCached(ctx context.Context, project, dir string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "docker", "compose", "-p", project, "up", "-d", "--pull", "missing", "--force-recreate", "--remove-orphans")
 	cmd.Dir = dir
-	return cmd.CombinedOutput()
+	return r.runWithAuth(cmd)
 }
 
-// ExecuteComposePull runs docker compose pull
-func (r *Runner) ExecuteComposePull(project, dir string) ([]byte, error) {
-	cmd := exec.Command("docker", "compose", "-p", project, "pull")
+// ExecuteComposeUpServices recreates the given services without touching their dependencies
+func (r *Runner) ExecuteComposeUpServices(ctx context.Context, project, dir string, services []string) ([]byte, error) {
+	args := []string{"compose", "-p", project, "up", "-d", "--no-deps", "--force-recreate"}
+	args = append(args, services...)
+	cmd := exec.CommandContext(ctx, "docker", args...)
 	cmd.Dir = dir
-	return cmd.CombinedOutput()
+	return r.runWithAuth(cmd)
 }
 
-// ExecuteComposeRestart runs docker compose restart
-func (r *Runner) ExecuteComposeRestart(project, dir string) ([]byte, error) {
-	cmd := exec.Command("docker", "compose", "-p", project, "restart")
+// ExecuteComposeDown runs docker compose down. Volumes are kept, see
+// RemoveVolume.
+func (r *Runner) ExecuteComposeDown(ctx context.Context, project, dir string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "docker", "compose", "-p", project, "down", "--remove-orphans")
 	cmd.Dir = dir
-	return cmd.CombinedOutput()
+	return r.run(cmd)
 }
 
-// ExecuteComposePs returns the status of containers
-func (r *Runner) ExecuteComposePs(project, dir string) ([]byte, error) {
-	cmd := exec.Command("docker", "compose", "-p", project, "ps", "--format", "json")
+// ExecuteComposePull runs docker compose pull
+func (r *Runner) ExecuteComposePull(ctx context.Context, project, dir string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "docker", "compose", "-p", project, "pull")
 	cmd.Dir = dir
-	return cmd.CombinedOutput()
+	return r.runWithAuth(cmd)
 }
 
-// ExecuteComposeLogs returns the logs of containers
-func (r *Runner) ExecuteComposeLogs(project, dir string, tail int) ([]byte, error) {
-	tailStr := fmt.Sprintf("%d", tail)
-	cmd := exec.Command("docker", "compose", "-p", project, "logs", "--tail", tailStr, "--no-color")
-	cmd.Dir = dir
-	return cmd.CombinedOutput()
+// ComposeRestart restarts the containers of a compose project, restricted to
+// services when any are given
+func (r *Runner) ComposeRestart(ctx context.Context, project string, services ...string) error {
+	containers, err := r.projectContainers(ctx, project)
+	if err != nil {
+		return err
+	}
+	containers = filterServices(containers, services)
+
+	for _, c := range containers {
+		if err := r.engine.RestartContainer(ctx, c.ID, stopTimeout); err != nil {
+			return fmt.Errorf("failed to restart %s: %w", c.Name(), err)
+		}
+	}
+	return nil
 }
 
-// ExecuteComposeImages returns the images used by the services
-func (r *Runner) ExecuteComposeImages(project, dir string) ([]byte, error) {
-	cmd := exec.Command("docker", "compose", "-p", project, "images", "--format", "json")
-	cmd.Dir = dir
-	return cmd.CombinedOutput()
+// ComposeStop stops the running containers of a compose project, keeping the
+// containers, their volumes and networks so ComposeStart can bring them back.
+// It returns the names of the containers it stopped.
+func (r *Runner) ComposeStop(ctx context.Context, project string) ([]string, error) {
+	containers, err := r.projectContainers(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("%s: %w", project, ErrNoContainers)
+	}
+
+	stopped := []string{}
+	for _, c := range containers {
+		if c.State != "running" {
+			continue
+		}
+		if err := r.engine.StopContainer(ctx, c.ID, stopTimeout); err != nil {
+			return nil, fmt.Errorf("failed to stop %s: %w", c.Name(), err)
+		}
+		stopped = append(stopped, c.Name())
+	}
+	return stopped, nil
+}
+
+// ComposeStart starts the named containers of a compose project, as returned
+// by ComposeStop. Names the project no longer has are skipped.
+func (r *Runner) ComposeStart(ctx context.Context, project string, names []string) error {
+	containers, err := r.projectContainers(ctx, project)
+	if err != nil {
+		return err
+	}
+	if len(containers) == 0 {
+		return fmt.Errorf("%s: %w", project, ErrNoContainers)
+	}
+
+	for _, c := range containers {
+		if !slices.Contains(names, c.Name()) {
+			continue
+		}
+		if err := r.engine.StartContainer(ctx, c.ID); err != nil {
+			return fmt.Errorf("failed to start %s: %w", c.Name(), err)
+		}
+	}
+	return nil
+}
+
+// ComposePs returns the status of the containers of a compose project
+func (r *Runner) ComposePs(ctx context.Context, project string) ([]ServiceContainer, error) {
+	containers, err := r.projectContainers(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ServiceContainer, 0, len(containers))
+	for _, c := range containers {
+		details, err := r.engine.InspectContainer(ctx, c.ID)
+		if err != nil {
+			if IsNotFound(err) {
+				continue // Removed between list and inspect
+			}
+			return nil, err
+		}
+
+		sc := ServiceContainer{
+			ID:           c.ID,
+			Name:         c.Name(),
+			Service:      c.Service(),
+			Image:        c.Image,
+			State:        c.State,
+			Status:       c.Status,
+			ExitCode:     details.State.ExitCode,
+			RestartCount: details.RestartCount,
+			Created:      details.Created,
+			Ports:        c.Ports,
+		}
+		if details.State.Running {
+			sc.StartedAt = details.State.StartedAt
+		}
+		if details.State.Health != nil {
+			sc.Health = details.State.Health.Status
+		}
+		result = append(result, sc)
+	}
+	return result, nil
+}
+
+// ComposeServices returns the services of a compose project, sorted, as
+// labelled on its containers
+func (r *Runner) ComposeServices(ctx context.Context, project string) ([]string, error) {
+	containers, err := r.projectContainers(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []string
+	for _, c := range containers {
+		if svc := c.Service(); svc != "" && !slices.Contains(services, svc) {
+			services = append(services, svc)
+		}
+	}
+	slices.Sort(services)
+	return services, nil
+}
+
+// ComposeLogs writes the logs of the containers of a compose project to dst,
+// each line prefixed with the container name. Containers are read one after
+// the other, or all at once until ctx is done when following.
+func (r *Runner) ComposeLogs(ctx context.Context, project string, opts ComposeLogsOptions, dst io.Writer) error {
+	containers, err := r.projectContainers(ctx, project)
+	if err != nil {
+		return err
+	}
+	containers = filterServices(containers, opts.Services)
+
+	if !opts.Follow {
+		for _, c := range containers {
+			if err := r.containerLogs(ctx, dst, c, opts.LogsOptions); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Follow every container at once, interleaving whole lines
+	sink := &lineSink{dst: dst}
+	errs := make(chan error, len(containers))
+	var wg sync.WaitGroup
+	for _, c := range containers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := sink.writer()
+			err := r.containerLogs(ctx, w, c, opts.LogsOptions)
+			if flushErr := w.Flush(); err == nil {
+				err = flushErr
+			}
+			if err != nil && ctx.Err() == nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// ComposeImages returns the images used by the containers of a compose project
+func (r *Runner) ComposeImages(ctx context.Context, project string) ([]ServiceImage, error) {
+	containers, err := r.projectContainers(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ServiceImage, 0, len(containers))
+	for _, c := range containers {
+		// The list endpoint shows an image ID once the tag moved; the
+		// container config always keeps the reference it was created from
+		details, err := r.engine.InspectContainer(ctx, c.ID)
+		if err != nil {
+			if IsNotFound(err) {
+				continue // Removed between list and inspect
+			}
+			return nil, err
+		}
+		img, err := r.engine.InspectImage(ctx, c.ImageID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect image of %s: %w", c.Name(), err)
+		}
+		result = append(result, ServiceImage{
+			Service:     c.Service(),
+			Container:   c.Name(),
+			Image:       details.Config.Image,
+			ImageID:     img.ID,
+			RepoTags:    img.RepoTags,
+			RepoDigests: img.RepoDigests,
+			Created:     img.Created,
+			Size:        img.Size,
+		})
+	}
+	return result, nil
+}
+
+// ImageID resolves an image reference to the ID of the local image it points to
+func (r *Runner) ImageID(ctx context.Context, ref string) (string, error) {
+	img, err := r.engine.InspectImage(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	return img.ID, nil
+}
+
+// ComposeVolumes returns the volumes created for a compose project, sorted by
+// name. They outlive the project containers until removed.
+func (r *Runner) ComposeVolumes(ctx context.Context, project string) ([]string, error) {
+	volumes, err := r.engine.ListVolumes(ctx, LabelProject+"="+project)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(volumes))
+	for _, v := range volumes {
+		names = append(names, v.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RemoveVolume removes a volume
+func (r *Runner) RemoveVolume(ctx context.Context, name string) error {
+	return r.engine.RemoveVolume(ctx, name)
+}
+
+// BackupVolume writes a gzipped tar archive of the contents of a volume to
+// dst. The volume is mounted read-only in a throwaway container.
+func (r *Runner) BackupVolume(ctx context.Context, volume string, dst io.Writer) error {
+	cmd := exec.CommandContext(ctx, "docker", "run", "--rm", "--network", "none",
+		"-v", volume+":/volume:ro",
+		backupImage,
+		"tar", "czf", "-", "-C", "/volume", ".",
+	)
+	var stderr bytes.Buffer
+	cmd.Stdout = dst
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		r.failed(cmd)
+		return fmt.Errorf("failed to back up volume %s: %w: %s", volume, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// RestoreVolume creates a volume of a compose project, labeled so that
+// docker compose adopts it, and extracts into it a gzipped tar archive read
+// from src, as written by BackupVolume
+func (r *Runner) RestoreVolume(ctx context.Context, project, volume string, src io.Reader) error {
+	short := strings.TrimPrefix(volume, project+"_")
+	out, err := r.run(exec.CommandContext(ctx, "docker", "volume", "create",
+		"--label", LabelProject+"="+project,
+		"--label", LabelVolume+"="+short,
+		volume,
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create volume %s: %w: %s", volume, err, bytes.TrimSpace(out))
+	}
+
+	cmd := exec.CommandContext(ctx, "docker", "run", "--rm", "-i", "--network", "none",
+		"-v", volume+":/volume",
+		backupImage,
+		"tar", "xzf", "-", "-C", "/volume",
+	)
+	cmd.Stdin = src
+	if out, err := r.run(cmd); err != nil {
+		return fmt.Errorf("failed to restore volume %s: %w: %s", volume, err, bytes.TrimSpace(out))
+	}
+	return nil
 }
 
 // IsInstalled checks if docker and compose are available
@@ -70,21 +390,130 @@ func (r *Runner) IsInstalled() bool {
 	return err == nil
 }
 
-// ExecuteMongoScript executes a script in a mongo container
-func (r *Runner) ExecuteMongoScript(host, script string) ([]byte, error) {
+// ExecuteMongoScript executes a script in a mongo container. Values in env
+// are handed to the script as environment variables, readable through
+// process.env, so they never become part of the script source or the
+// container command line.
+func (r *Runner) ExecuteMongoScript(ctx context.Context, host, script string, env map[string]string) ([]byte, error) {
 	// args for docker run
 	// --rm: remove container after run
 	// --network host: use host network to reach the mongo instance
+	// -e NAME: forward NAME from the docker CLI environment
 	// mongo:latest: image to use
 	// mongosh ...: command to run
-	args := []string{
-		"run", "--rm", "--network", "host",
+	args := []string{"run", "--rm", "--network", "host"}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The Q8_MONGO_* settings of the agent must not shadow or duplicate the
+	// script variables
+	cmdEnv := slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		return strings.HasPrefix(kv, mongoEnvPrefix)
+	})
+	for _, name := range names {
+		args = append(args, "-e", name)
+		cmdEnv = append(cmdEnv, name+"="+env[name])
+	}
+
+	args = append(args,
 		"mongo:latest",
-		"mongosh",
+		"mongosh", "--quiet",
 		host,
 		"--eval", script,
+	)
+
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Env = cmdEnv
+	return r.run(cmd)
+}
+
+// runWithAuth runs cmd with an isolated DOCKER_CONFIG holding the registry
+// logins, removed as soon as the command exits
+func (r *Runner) runWithAuth(cmd *exec.Cmd) ([]byte, error) {
+	if r.auth == nil {
+		return r.run(cmd)
+	}
+
+	dir, cleanup, err := r.auth.DockerConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare registry credentials: %w", err)
+	}
+	defer cleanup()
+
+	if dir != "" {
+		cmd.Env = append(os.Environ(), "DOCKER_CONFIG="+dir)
+	}
+	return r.run(cmd)
+}
+
+// run runs cmd and returns its combined output, counting it when it fails
+func (r *Runner) run(cmd *exec.Cmd) ([]byte, error) {
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.failed(cmd)
+	}
+	return out, err
+}
+
+// failed counts a failed docker CLI command
+func (r *Runner) failed(cmd *exec.Cmd) {
+	r.failures.Inc("cli", commandName(cmd.Args[1:]))
+}
+
+// commandName names a docker CLI command for metrics, such as compose up or
+// volume create, leaving out its flags and operands
+func commandName(args []string) string {
+	switch {
+	case len(args) >= 4 && args[0] == "compose" && args[1] == "-p":
+		return "compose " + args[3]
+	case len(args) >= 2 && args[0] == "volume":
+		return "volume " + args[1]
+	case len(args) >= 1:
+		return args[0]
+	}
+	return ""
+}
+
+// projectContainers lists the containers of a compose project ordered by
+// service, then by name
+func (r *Runner) projectContainers(ctx context.Context, project string) ([]Container, error) {
+	containers, err := r.engine.ListContainers(ctx, LabelProject+"="+project)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(containers, func(a, b Container) int {
+		return cmp.Or(strings.Compare(a.Service(), b.Service()), strings.Compare(a.Name(), b.Name()))
+	})
+	return containers, nil
+}
+
+// filterServices keeps the containers of services. No services keeps all.
+func filterServices(containers []Container, services []string) []Container {
+	if len(services) == 0 {
+		return containers
+	}
+	return slices.DeleteFunc(containers, func(c Container) bool {
+		return !slices.Contains(services, c.Service())
+	})
+}
+
+// containerLogs writes the logs of a single container to dst with a compose-like prefix
+func (r *Runner) containerLogs(ctx context.Context, dst io.Writer, c Container, opts LogsOptions) error {
+	details, err := r.engine.InspectContainer(ctx, c.ID)
+	if err != nil {
+		return err
+	}
+
+	stream, err := r.engine.ContainerLogs(ctx, c.ID, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read logs of %s: %w", c.Name(), err)
 	}
+	defer stream.Close()
 
-	cmd := exec.Command("docker", args...)
-	return cmd.CombinedOutput()
+	return copyLogs(newPrefixWriter(dst, c.Name()+"  | "), stream, details.Config.Tty)
 }
@@ -0,0 +1,160 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestComposeImagesSkipsRemovedContainers(t *testing.T) {
+	c := newFakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/json":
+			writeEngineJSON(w, http.StatusOK, []Container{
+				{ID: "gone", Names: []string{"/q8-acme-old-1"}, ImageID: "sha256:old", Labels: map[string]string{LabelService: "old"}},
+				{ID: "web", Names: []string{"/q8-acme-web-1"}, ImageID: "sha256:web", Labels: map[string]string{LabelService: "web"}},
+			})
+		case "/containers/web/json":
+			writeEngineJSON(w, http.StatusOK, ContainerDetails{ID: "web", Config: ContainerConfig{Image: "nginx:latest"}})
+		case "/images/sha256:web/json":
+			writeEngineJSON(w, http.StatusOK, ImageDetails{ID: "sha256:web", RepoTags: []string{"nginx:latest"}})
+		default:
+			writeEngineJSON(w, http.StatusNotFound, map[string]string{"message": "not found"})
+		}
+	}))
+
+	images, err := NewRunner(c, nil).ComposeImages(context.Background(), "q8-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Service != "web" || images[0].Image != "nginx:latest" || images[0].ImageID != "sha256:web" {
+		t.Errorf("images = %+v, want only the web container", images)
+	}
+}
+
+func TestComposeServicesFromLabels(t *testing.T) {
+	c := newFakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeEngineJSON(w, http.StatusOK, []Container{
+			{ID: "w2", Names: []string{"/q8-acme-worker-2"}, Labels: map[string]string{LabelService: "worker"}},
+			{ID: "w1", Names: []string{"/q8-acme-worker-1"}, Labels: map[string]string{LabelService: "worker"}},
+			{ID: "web", Names: []string{"/q8-acme-web-1"}, Labels: map[string]string{LabelService: "web"}},
+			{ID: "x", Names: []string{"/q8-acme-run"}},
+		})
+	}))
+
+	services, err := NewRunner(c, nil).ComposeServices(context.Background(), "q8-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(services, []string{"web", "worker"}) {
+		t.Errorf("services = %v, want [web worker]", services)
+	}
+}
+
+func TestComposeStopStart(t *testing.T) {
+	var stopped, started []string
+	containers := []Container{}
+	c := newFakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case path == "/containers/json":
+			writeEngineJSON(w, http.StatusOK, containers)
+		case strings.HasSuffix(path, "/stop"):
+			stopped = append(stopped, strings.Split(path, "/")[2])
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(path, "/start"):
+			started = append(started, strings.Split(path, "/")[2])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	runner := NewRunner(c, nil)
+	ctx := context.Background()
+
+	if _, err := runner.ComposeStop(ctx, "q8-acme"); !errors.Is(err, ErrNoContainers) {
+		t.Fatalf("ComposeStop without containers: err = %v, want ErrNoContainers", err)
+	}
+	if err := runner.ComposeStart(ctx, "q8-acme", nil); !errors.Is(err, ErrNoContainers) {
+		t.Fatalf("ComposeStart without containers: err = %v, want ErrNoContainers", err)
+	}
+
+	containers = []Container{
+		{ID: "web", Names: []string{"/q8-acme-web-1"}, State: "running"},
+		{ID: "job", Names: []string{"/q8-acme-job-1"}, State: "exited"},
+	}
+	names, err := runner.ComposeStop(ctx, "q8-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, []string{"q8-acme-web-1"}) || !slices.Equal(stopped, []string{"web"}) {
+		t.Errorf("stopped %v (engine %v), want only the running web container", names, stopped)
+	}
+
+	if err := runner.ComposeStart(ctx, "q8-acme", append(names, "q8-acme-gone-1")); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(started, []string{"web"}) {
+		t.Errorf("started %v, want only the web container", started)
+	}
+}
+
+func TestExecuteMongoScriptEnv(t *testing.T) {
+	// A fake docker CLI printing its arguments and environment
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho \"$@\"\nenv\n"
+	if err := os.WriteFile(filepath.Join(bin, "docker"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("Q8_MONGO_USER", "admin")
+	t.Setenv("Q8_MONGO_PASSWORD", "admin-password")
+
+	out, err := NewRunner(nil, nil).ExecuteMongoScript(context.Background(), "127.0.0.1", "print(1)", map[string]string{
+		"Q8_MONGO_TENANT_USER":     "acme",
+		"Q8_MONGO_TENANT_PASSWORD": "acme-password",
+	})
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	lines := strings.Split(string(out), "\n")
+	if !strings.Contains(lines[0], "-e Q8_MONGO_TENANT_PASSWORD -e Q8_MONGO_TENANT_USER") {
+		t.Errorf("args = %s, want the tenant variables forwarded", lines[0])
+	}
+	if !slices.Contains(lines, "Q8_MONGO_TENANT_USER=acme") || !slices.Contains(lines, "Q8_MONGO_TENANT_PASSWORD=acme-password") {
+		t.Errorf("environment lacks the tenant variables:\n%s", out)
+	}
+	for _, l := range lines {
+		if strings.HasPrefix(l, "Q8_MONGO_USER=") || strings.HasPrefix(l, "Q8_MONGO_PASSWORD=") {
+			t.Errorf("inherited agent setting %s reached the script", l)
+		}
+	}
+}
+
+func TestProjectContainersOrder(t *testing.T) {
+	c := newFakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeEngineJSON(w, http.StatusOK, []Container{
+			{ID: "w2", Names: []string{"/q8-acme-worker-2"}, Labels: map[string]string{LabelService: "worker"}},
+			{ID: "z", Names: []string{"/a-custom-name"}, Labels: map[string]string{LabelService: "zeta"}},
+			{ID: "w1", Names: []string{"/q8-acme-worker-1"}, Labels: map[string]string{LabelService: "worker"}},
+			{ID: "web", Names: []string{"/q8-acme-web-1"}, Labels: map[string]string{LabelService: "web"}},
+		})
+	}))
+
+	containers, err := NewRunner(c, nil).projectContainers(context.Background(), "q8-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	if want := []string{"web", "w1", "w2", "z"}; !slices.Equal(ids, want) {
+		t.Errorf("order = %v, want %v", ids, want)
+	}
+}
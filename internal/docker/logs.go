@@ -0,0 +1,117 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DemuxLogs copies a multiplexed engine log stream to dst, dropping the 8-byte
+// frame headers. Stdout and stderr frames are written in the order received.
+func DemuxLogs(dst io.Writer, src io.Reader) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(src, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read log frame header: %w", err)
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(dst, src, size); err != nil {
+			return fmt.Errorf("failed to read log frame: %w", err)
+		}
+	}
+}
+
+// prefixWriter prefixes every line written to it, like docker compose logs does
+type prefixWriter struct {
+	dst     io.Writer
+	prefix  []byte
+	midLine bool
+}
+
+func newPrefixWriter(dst io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{dst: dst, prefix: []byte(prefix)}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	for _, b := range p {
+		if !w.midLine {
+			buf.Write(w.prefix)
+			w.midLine = true
+		}
+		buf.WriteByte(b)
+		if b == '\n' {
+			w.midLine = false
+		}
+	}
+	if _, err := w.dst.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// lineSink serializes writes of concurrent log streams so that lines from
+// different containers never interleave mid-line
+type lineSink struct {
+	mu  sync.Mutex
+	dst io.Writer
+}
+
+// writer returns a writer forwarding complete lines to the sink
+func (s *lineSink) writer() *lineWriter {
+	return &lineWriter{sink: s}
+}
+
+// lineWriter buffers a partial line until its newline is written
+type lineWriter struct {
+	sink *lineSink
+	buf  []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	i := bytes.LastIndexByte(w.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+
+	if err := w.emit(w.buf[:i+1]); err != nil {
+		return 0, err
+	}
+	w.buf = append(w.buf[:0], w.buf[i+1:]...)
+	return len(p), nil
+}
+
+// Flush writes a trailing partial line, terminating it
+func (w *lineWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.emit(append(w.buf, '\n'))
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *lineWriter) emit(lines []byte) error {
+	w.sink.mu.Lock()
+	defer w.sink.mu.Unlock()
+	_, err := w.sink.dst.Write(lines)
+	return err
+}
+
+// copyLogs copies a container log stream to dst, demultiplexing it unless the
+// container was started with a TTY
+func copyLogs(dst io.Writer, src io.Reader, tty bool) error {
+	if tty {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	return DemuxLogs(dst, src)
+}
@@ -0,0 +1,136 @@
+package docker
+
+import "time"
+
+// Port is a port mapping as reported by the container list endpoint
+type Port struct {
+	IP          string `json:"IP,omitempty"`
+	PrivatePort uint16 `json:"PrivatePort"`
+	PublicPort  uint16 `json:"PublicPort,omitempty"`
+	Type        string `json:"Type"`
+}
+
+// Container is a container summary as returned by GET /containers/json
+type Container struct {
+	ID      string            `json:"Id"`
+	Names   []string          `json:"Names"`
+	Image   string            `json:"Image"`
+	ImageID string            `json:"ImageID"`
+	Command string            `json:"Command"`
+	Created int64             `json:"Created"`
+	Ports   []Port            `json:"Ports"`
+	Labels  map[string]string `json:"Labels"`
+	State   string            `json:"State"`
+	Status  string            `json:"Status"`
+}
+
+// Service returns the compose service the container belongs to
+func (c Container) Service() string {
+	return c.Labels[LabelService]
+}
+
+// Name returns the container name without the leading slash
+func (c Container) Name() string {
+	if len(c.Names) == 0 {
+		return ""
+	}
+	name := c.Names[0]
+	if len(name) > 0 && name[0] == '/' {
+		name = name[1:]
+	}
+	return name
+}
+
+// ContainerState is the state section of a container inspect answer
+type ContainerState struct {
+	Status     string `json:"Status"`
+	Running    bool   `json:"Running"`
+	Paused     bool   `json:"Paused"`
+	Restarting bool   `json:"Restarting"`
+	ExitCode   int    `json:"ExitCode"`
+	StartedAt  string `json:"StartedAt"`
+	FinishedAt string `json:"FinishedAt"`
+	Health     *struct {
+		Status string `json:"Status"`
+	} `json:"Health,omitempty"`
+}
+
+// ContainerConfig is the config section of a container inspect answer
+type ContainerConfig struct {
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+	Tty    bool              `json:"Tty"`
+}
+
+// ContainerDetails is the answer of GET /containers/{id}/json
+type ContainerDetails struct {
+	ID           string          `json:"Id"`
+	Name         string          `json:"Name"`
+	Created      string          `json:"Created"`
+	Image        string          `json:"Image"`
+	RestartCount int             `json:"RestartCount"`
+	State        ContainerState  `json:"State"`
+	Config       ContainerConfig `json:"Config"`
+}
+
+// Volume is an entry of GET /volumes
+type Volume struct {
+	Name       string            `json:"Name"`
+	Driver     string            `json:"Driver"`
+	Mountpoint string            `json:"Mountpoint"`
+	CreatedAt  string            `json:"CreatedAt"`
+	Labels     map[string]string `json:"Labels"`
+}
+
+// ImageDetails is the answer of GET /images/{name}/json
+type ImageDetails struct {
+	ID          string   `json:"Id"`
+	RepoTags    []string `json:"RepoTags"`
+	RepoDigests []string `json:"RepoDigests"`
+	Created     string   `json:"Created"`
+	Size        int64    `json:"Size"`
+}
+
+// LogsOptions controls which log lines are returned by the engine
+type LogsOptions struct {
+	Tail       int
+	Follow     bool
+	Timestamps bool
+	Since      time.Time
+	Until      time.Time
+}
+
+// ComposeLogsOptions selects the logs of a compose project. Services restricts
+// the containers read when not empty.
+type ComposeLogsOptions struct {
+	LogsOptions
+	Services []string
+}
+
+// ServiceContainer is the per-container status of a compose project
+type ServiceContainer struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Service      string `json:"service"`
+	Image        string `json:"image"`
+	State        string `json:"state"`
+	Status       string `json:"status"`
+	Health       string `json:"health,omitempty"`
+	ExitCode     int    `json:"exit_code"`
+	RestartCount int    `json:"restart_count"`
+	Created      string `json:"created"`
+	StartedAt    string `json:"started_at,omitempty"`
+	Ports        []Port `json:"ports,omitempty"`
+}
+
+// ServiceImage is the image currently used by a container of a compose project
+type ServiceImage struct {
+	Service     string   `json:"service"`
+	Container   string   `json:"container"`
+	Image       string   `json:"image"`
+	ImageID     string   `json:"image_id"`
+	RepoTags    []string `json:"repo_tags"`
+	RepoDigests []string `json:"repo_digests"`
+	Created     string   `json:"created"`
+	Size        int64    `json:"size"`
+}
@@ -0,0 +1,134 @@
+package domain
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrorCode is a stable, machine-readable error identifier exposed by the API
+type ErrorCode string
+
+// Error codes
+const (
+	CodeInvalidRequest    ErrorCode = "invalid_request"
+	CodeValidation        ErrorCode = "validation_failed"
+	CodeUnauthorized      ErrorCode = "unauthorized"
+	CodeForbidden         ErrorCode = "forbidden"
+	CodeNotFound          ErrorCode = "not_found"
+	CodeTenantNotFound    ErrorCode = "tenant_not_found"
+	CodeJobNotFound       ErrorCode = "job_not_found"
+	CodeServiceNotFound   ErrorCode = "service_not_found"
+	CodeMethodNotAllowed  ErrorCode = "method_not_allowed"
+	CodeConflict          ErrorCode = "conflict"
+	CodeTenantBusy        ErrorCode = "tenant_busy"
+	CodeTenantSuspended   ErrorCode = "tenant_suspended"
+	CodeImagePullFailed   ErrorCode = "image_pull_failed"
+	CodeComposeFailed     ErrorCode = "compose_failed"
+	CodeDockerError       ErrorCode = "docker_error"
+	CodeDockerUnavailable ErrorCode = "docker_unavailable"
+	CodeMongoFailed       ErrorCode = "mongo_failed"
+	CodeQueueFull         ErrorCode = "queue_full"
+	CodeShuttingDown      ErrorCode = "shutting_down"
+	CodeInternal          ErrorCode = "internal_error"
+)
+
+// HTTPStatus returns the HTTP status answered for the code
+func (c ErrorCode) HTTPStatus() int {
+	switch c {
+	case CodeInvalidRequest, CodeValidation:
+		return http.StatusBadRequest
+	case CodeUnauthorized:
+		return http.StatusUnauthorized
+	case CodeForbidden:
+		return http.StatusForbidden
+	case CodeNotFound, CodeTenantNotFound, CodeJobNotFound, CodeServiceNotFound:
+		return http.StatusNotFound
+	case CodeMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case CodeConflict, CodeTenantBusy, CodeTenantSuspended:
+		return http.StatusConflict
+	case CodeImagePullFailed, CodeComposeFailed, CodeDockerError, CodeMongoFailed:
+		return http.StatusBadGateway
+	case CodeDockerUnavailable, CodeQueueFull, CodeShuttingDown:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Error is an error carrying a stable code. Details holds structured context
+// such as command output; it is reported to clients but not part of Error().
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details any
+	Err     error
+}
+
+// NewError creates an error with a code and a message
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// WrapError attaches a code and a message to err
+func WrapError(code ErrorCode, message string, err error) *Error {
+	return &Error{Code: code, Message: message, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode implements the coded error interface used by CodeOf
+func (e *Error) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+// ErrorDetails implements the detailed error interface used by DetailsOf
+func (e *Error) ErrorDetails() any {
+	return e.Details
+}
+
+// ErrorCode reports validation errors as CodeValidation
+func (e *ValidationError) ErrorCode() ErrorCode {
+	return CodeValidation
+}
+
+// ErrorDetails describes the rejected field
+func (e *ValidationError) ErrorDetails() any {
+	return e
+}
+
+// CodeOf returns the code of the outermost error in the chain of err that
+// carries one, or CodeInternal
+func CodeOf(err error) ErrorCode {
+	var coded interface{ ErrorCode() ErrorCode }
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	return CodeInternal
+}
+
+// DetailsOf returns the details of the outermost error in the chain of err
+// that carries some, or nil
+func DetailsOf(err error) any {
+	var detailed interface{ ErrorDetails() any }
+	for errors.As(err, &detailed) {
+		if d := detailed.ErrorDetails(); d != nil {
+			return d
+		}
+		next := errors.Unwrap(detailed.(error))
+		if next == nil {
+			return nil
+		}
+		err = next
+	}
+	return nil
+}
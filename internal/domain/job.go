@@ -0,0 +1,50 @@
+package domain
+
+import "time"
+
+// JobType identifies the operation run by an asynchronous job
+type JobType string
+
+// Supported job types
+const (
+	JobProvision JobType = "provision"
+	JobTeardown  JobType = "teardown"
+	JobRestart   JobType = "restart"
+	JobUpdate    JobType = "update"
+	JobSuspend   JobType = "suspend"
+	JobResume    JobType = "resume"
+	JobRestore   JobType = "restore"
+	JobPurge     JobType = "purge"
+)
+
+// JobState is the lifecycle state of an asynchronous job
+type JobState string
+
+// Job states
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// Job represents an asynchronous tenant operation
+type Job struct {
+	ID         string     `json:"id"`
+	Type       JobType    `json:"type"`
+	Subdomain  string     `json:"subdomain"`
+	State      JobState   `json:"state"`
+	Step       string     `json:"step,omitempty"`
+	Output     string     `json:"output,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	ErrorCode  ErrorCode  `json:"error_code,omitempty"`
+	Result     any        `json:"result,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Done reports whether the job has reached a final state
+func (j Job) Done() bool {
+	return j.State == JobSucceeded || j.State == JobFailed
+}
@@ -1,5 +1,7 @@
 package domain
 
+import "time"
+
 // MongoDBUserCreateRequest represents a request to create a MongoDB user/db
 type MongoDBUserCreateRequest struct {
 	Host          string `json:"host"`
@@ -10,3 +12,78 @@ type MongoDBUserCreateRequest struct {
 	NewUser       string `json:"new_user"`
 	NewPassword   string `json:"new_password"`
 }
+
+// Validate checks the database name, user name and password of the request.
+// Host and admin credentials are ignored in favour of the agent configuration.
+func (r MongoDBUserCreateRequest) Validate() error {
+	if err := ValidateMongoDatabase("database_name", r.DatabaseName); err != nil {
+		return err
+	}
+	if err := ValidateMongoUser("new_user", r.NewUser); err != nil {
+		return err
+	}
+	return ValidateMongoPassword("new_password", r.NewPassword)
+}
+
+// MongoPasswordRotateRequest optionally supplies the new password of a user.
+// The agent generates one when it is empty.
+type MongoPasswordRotateRequest struct {
+	Password string `json:"password,omitempty"`
+}
+
+// MongoCredentials is the outcome of a password rotation. The password is
+// only ever returned in this response.
+type MongoCredentials struct {
+	Database  string `json:"database"`
+	User      string `json:"user"`
+	Password  string `json:"password"`
+	Generated bool   `json:"generated"`
+}
+
+// MongoDatabase describes a database holding users managed by the agent
+type MongoDatabase struct {
+	Name      string   `json:"name"`
+	Exists    bool     `json:"exists"`
+	SizeBytes int64    `json:"size_bytes"`
+	Users     []string `json:"users"`
+}
+
+// MongoDropResult describes a dropped database and the users removed with it
+type MongoDropResult struct {
+	Database     string   `json:"database"`
+	DroppedUsers []string `json:"dropped_users"`
+}
+
+// TenantUpdateRequest represents a request to pull and recreate changed services
+type TenantUpdateRequest struct {
+	Subdomain string   `json:"subdomain"`
+	Services  []string `json:"services,omitempty"`
+}
+
+// ServiceUpdate describes a service recreated with a new image
+type ServiceUpdate struct {
+	Service    string `json:"service"`
+	Image      string `json:"image"`
+	OldImageID string `json:"old_image_id"`
+	NewImageID string `json:"new_image_id"`
+}
+
+// TenantUpdateResult reports which services an update recreated
+type TenantUpdateResult struct {
+	Updated   []ServiceUpdate `json:"updated"`
+	Unchanged []string        `json:"unchanged"`
+}
+
+// RegistryCredentialRequest sets the credentials of a container registry
+type RegistryCredentialRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// RegistryInfo describes a configured registry without its secret
+type RegistryInfo struct {
+	Host      string    `json:"host"`
+	Username  string    `json:"username"`
+	Source    string    `json:"source"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,43 @@
+package domain
+
+import "regexp"
+
+var (
+	// secretPlaceholderPattern matches ${q8:secret:NAME} in env content
+	secretPlaceholderPattern = regexp.MustCompile(`\$\{q8:secret:([A-Za-z_][A-Za-z0-9_]*)\}`)
+	// agentPlaceholderPattern matches anything that looks like an agent placeholder
+	agentPlaceholderPattern = regexp.MustCompile(`\$\{q8:[^}]*\}?`)
+)
+
+// SecretPlaceholders returns the distinct secret names referenced by
+// ${q8:secret:NAME} placeholders in env, in order of appearance. Malformed
+// agent placeholders are rejected rather than written out verbatim.
+func SecretPlaceholders(env string) ([]string, error) {
+	for _, m := range agentPlaceholderPattern.FindAllString(env, -1) {
+		if !secretPlaceholderPattern.MatchString(m) {
+			return nil, &ValidationError{
+				Field:  "env_content",
+				Value:  m,
+				Reason: "placeholders must have the form ${q8:secret:NAME} with NAME made of letters, digits and underscores",
+			}
+		}
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range secretPlaceholderPattern.FindAllStringSubmatch(env, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names, nil
+}
+
+// ExpandSecrets replaces the ${q8:secret:NAME} placeholders of env with values
+func ExpandSecrets(env string, values map[string]string) string {
+	return secretPlaceholderPattern.ReplaceAllStringFunc(env, func(m string) string {
+		name := secretPlaceholderPattern.FindStringSubmatch(m)[1]
+		return values[name]
+	})
+}
@@ -1,5 +1,7 @@
 package domain
 
+import "time"
+
 // TenantProvisionRequest represents the payload to provision a new tenant
 type TenantProvisionRequest struct {
 	ID             string `json:"id"`
@@ -8,6 +10,80 @@ type TenantProvisionRequest struct {
 	EnvContent     string `json:"env_content"`
 }
 
+// TenantProvisionResult is the result of a successful provision job. Secrets
+// holds the values generated for ${q8:secret:NAME} placeholders that no
+// earlier provision succeeded with; it is returned by the first read of the
+// job only.
+type TenantProvisionResult struct {
+	Secrets map[string]string `json:"secrets,omitempty"`
+}
+
+// TeardownMode selects what happens to the volumes of a torn down tenant
+type TeardownMode string
+
+// Teardown modes
+const (
+	// TeardownKeepVolumes keeps the volumes, which a later provision of the
+	// same subdomain reuses
+	TeardownKeepVolumes TeardownMode = "keep-volumes"
+	// TeardownBackup archives the volume contents with the config, then
+	// removes the volumes
+	TeardownBackup TeardownMode = "backup-then-delete"
+	// TeardownPurge removes the volumes and the config without an archive
+	TeardownPurge TeardownMode = "purge"
+)
+
+// TenantTeardownRequest is the optional body of a teardown request
+type TenantTeardownRequest struct {
+	Mode TeardownMode `json:"mode,omitempty"`
+}
+
+// Validate checks the mode, defaulting it to TeardownKeepVolumes
+func (r *TenantTeardownRequest) Validate() error {
+	switch r.Mode {
+	case "":
+		r.Mode = TeardownKeepVolumes
+	case TeardownKeepVolumes, TeardownBackup, TeardownPurge:
+	default:
+		return &ValidationError{Field: "mode", Value: string(r.Mode), Reason: "must be keep-volumes, backup-then-delete or purge"}
+	}
+	return nil
+}
+
+// TenantTeardownResult is the result of a teardown job
+type TenantTeardownResult struct {
+	Mode            TeardownMode `json:"mode"`
+	Archive         string       `json:"archive,omitempty"`
+	RetainedVolumes []string     `json:"retained_volumes,omitempty"`
+	BackedUp        []string     `json:"backed_up,omitempty"`
+	RemovedVolumes  []string     `json:"removed_volumes,omitempty"`
+}
+
+// Archive describes the archived directory of a torn down tenant
+type Archive struct {
+	Name            string    `json:"name"`
+	Subdomain       string    `json:"subdomain"`
+	ArchivedAt      time.Time `json:"archived_at"`
+	SizeBytes       int64     `json:"size_bytes"`
+	RetainedVolumes []string  `json:"retained_volumes,omitempty"`
+	VolumeBackups   []string  `json:"volume_backups,omitempty"`
+}
+
+// ArchiveRestoreResult is the result of an archive restore job
+type ArchiveRestoreResult struct {
+	Archive         string   `json:"archive"`
+	Subdomain       string   `json:"subdomain"`
+	RestoredVolumes []string `json:"restored_volumes,omitempty"`
+}
+
+// ArchivePurgeResult describes a purged archive. Retained volumes are only
+// removed while no tenant uses them again.
+type ArchivePurgeResult struct {
+	Archive        string   `json:"archive"`
+	RemovedVolumes []string `json:"removed_volumes,omitempty"`
+	KeptVolumes    []string `json:"kept_volumes,omitempty"`
+}
+
 // TenantActionRequest represents a simple action on an existing tenant
 type TenantActionRequest struct {
 	ID string `json:"id"`
@@ -19,3 +95,45 @@ type TenantStatus struct {
 	Status string `json:"status"`
 	Uptime string `json:"uptime"`
 }
+
+// TenantState is the lifecycle state of a managed tenant
+type TenantState string
+
+// Tenant states
+const (
+	TenantActive    TenantState = "active"
+	TenantFailed    TenantState = "failed"
+	TenantSuspended TenantState = "suspended"
+	TenantTornDown  TenantState = "torn_down"
+)
+
+// TenantRecord is what the agent remembers about a tenant it manages
+type TenantRecord struct {
+	ID              string      `json:"id"`
+	Subdomain       string      `json:"subdomain"`
+	State           TenantState `json:"state"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+	LastOperation   JobType     `json:"last_operation,omitempty"`
+	LastResult      JobState    `json:"last_result,omitempty"`
+	LastError       string      `json:"last_error,omitempty"`
+	LastOperationAt *time.Time  `json:"last_operation_at,omitempty"`
+	SuspendedAt     *time.Time  `json:"suspended_at,omitempty"`
+	// SuspendedContainers are the containers the last suspend stopped, which
+	// resume starts again
+	SuspendedContainers []string `json:"suspended_containers,omitempty"`
+	// Archive is the directory the config was archived to by the last teardown
+	Archive string `json:"archive,omitempty"`
+	// RetainedVolumes are the volumes kept by the last teardown
+	RetainedVolumes []string `json:"retained_volumes,omitempty"`
+}
+
+// TenantFilter selects and paginates tenant records
+type TenantFilter struct {
+	State  TenantState
+	Query  string
+	Offset int
+	Limit  int
+	// Subdomains restricts the records to these tenants when not empty
+	Subdomains []string
+}
@@ -0,0 +1,174 @@
+package domain
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxSubdomainLength is the maximum length of a DNS label
+const MaxSubdomainLength = 63
+
+// MaxServiceNameLength bounds compose service names accepted in routes
+const MaxServiceNameLength = 63
+
+// Limits of MongoDB names and passwords accepted by the agent
+const (
+	MaxMongoNameLength     = 63
+	MaxMongoPasswordLength = 256
+)
+
+var (
+	subdomainPattern   = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	archiveNamePattern = regexp.MustCompile(`-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	mongoNamePattern   = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_-]*[a-zA-Z0-9])?$`)
+	servicePattern     = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// reservedMongoDatabases are the system databases of a MongoDB deployment
+var reservedMongoDatabases = map[string]bool{
+	"admin":  true,
+	"local":  true,
+	"config": true,
+}
+
+// reservedSubdomains cannot be used by tenants, either because they are
+// infrastructure hostnames or because they clash with API route segments
+var reservedSubdomains = map[string]bool{
+	"www":       true,
+	"api":       true,
+	"admin":     true,
+	"agent":     true,
+	"traefik":   true,
+	"localhost": true,
+	"mail":      true,
+	"provision": true,
+	"teardown":  true,
+	"restart":   true,
+	"suspend":   true,
+	"resume":    true,
+	"status":    true,
+	"logs":      true,
+	"images":    true,
+	"update":    true,
+}
+
+// ValidationError describes why a request field was rejected
+type ValidationError struct {
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+	}
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// ValidateSubdomain checks that subdomain is a safe tenant identifier: a
+// lowercase DNS label that is not reserved. It is used as a directory name
+// under the tenants root and as part of the compose project name.
+func ValidateSubdomain(subdomain string) error {
+	invalid := func(reason string) error {
+		return &ValidationError{Field: "subdomain", Value: subdomain, Reason: reason}
+	}
+
+	switch {
+	case subdomain == "":
+		return invalid("must not be empty")
+	case len(subdomain) > MaxSubdomainLength:
+		return invalid(fmt.Sprintf("must be at most %d characters", MaxSubdomainLength))
+	case !subdomainPattern.MatchString(subdomain):
+		return invalid("must contain only lowercase letters, digits and hyphens, and start and end with a letter or digit")
+	case reservedSubdomains[subdomain]:
+		return invalid("is reserved")
+	case archiveNamePattern.MatchString(subdomain):
+		return invalid("must not end with a UUID, which is reserved for archived tenants")
+	}
+	return nil
+}
+
+// ParseArchiveName checks that name is an archive directory name,
+// {subdomain}-{uuid}, and returns the subdomain
+func ParseArchiveName(name string) (string, error) {
+	loc := archiveNamePattern.FindStringIndex(name)
+	if loc == nil {
+		return "", &ValidationError{Field: "archive", Value: name, Reason: "must be a subdomain followed by a UUID"}
+	}
+	subdomain := name[:loc[0]]
+	if err := ValidateSubdomain(subdomain); err != nil {
+		return "", &ValidationError{Field: "archive", Value: name, Reason: "must start with a valid subdomain"}
+	}
+	return subdomain, nil
+}
+
+// ValidateServiceName checks that name is a valid compose service name
+func ValidateServiceName(name string) error {
+	invalid := func(reason string) error {
+		return &ValidationError{Field: "service", Value: name, Reason: reason}
+	}
+
+	switch {
+	case name == "":
+		return invalid("must not be empty")
+	case len(name) > MaxServiceNameLength:
+		return invalid(fmt.Sprintf("must be at most %d characters", MaxServiceNameLength))
+	case !servicePattern.MatchString(name):
+		return invalid("must contain only letters, digits, underscores, dots and hyphens, and start with a letter or digit")
+	}
+	return nil
+}
+
+// ValidateMongoDatabase checks that name is a tenant database name: letters,
+// digits, underscores and hyphens, excluding the system databases. field is
+// the request field reported on error.
+func ValidateMongoDatabase(field, name string) error {
+	if err := validateMongoName(field, name); err != nil {
+		return err
+	}
+	if reservedMongoDatabases[strings.ToLower(name)] {
+		return &ValidationError{Field: field, Value: name, Reason: "is a system database"}
+	}
+	return nil
+}
+
+// ValidateMongoUser checks that name is a safe MongoDB user name
+func ValidateMongoUser(field, name string) error {
+	return validateMongoName(field, name)
+}
+
+// ValidateMongoPassword checks the length of a MongoDB password. The value is
+// never echoed back in the error.
+func ValidateMongoPassword(field, password string) error {
+	invalid := func(reason string) error {
+		return &ValidationError{Field: field, Reason: reason}
+	}
+
+	switch {
+	case password == "":
+		return invalid("must not be empty")
+	case len(password) > MaxMongoPasswordLength:
+		return invalid(fmt.Sprintf("must be at most %d characters", MaxMongoPasswordLength))
+	case strings.ContainsRune(password, 0):
+		return invalid("must not contain NUL characters")
+	}
+	return nil
+}
+
+func validateMongoName(field, name string) error {
+	invalid := func(reason string) error {
+		return &ValidationError{Field: field, Value: name, Reason: reason}
+	}
+
+	switch {
+	case name == "":
+		return invalid("must not be empty")
+	case len(name) > MaxMongoNameLength:
+		return invalid(fmt.Sprintf("must be at most %d characters", MaxMongoNameLength))
+	case !mongoNamePattern.MatchString(name):
+		return invalid("must contain only letters, digits, underscores and hyphens, and start and end with a letter or digit")
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// archiveMetaFile describes an archive. Archives made before it existed have
+// none; their subdomain comes from the name and their time from the mtime.
+const archiveMetaFile = ".q8-archive.json"
+
+// ErrTenantExists is returned when restoring an archive over an active tenant
+var ErrTenantExists = errors.New("tenant directory already exists")
+
+// archiveMeta is the content of archiveMetaFile
+type archiveMeta struct {
+	Subdomain       string    `json:"subdomain"`
+	ArchivedAt      time.Time `json:"archived_at"`
+	RetainedVolumes []string  `json:"retained_volumes,omitempty"`
+}
+
+// ListArchives returns the archived tenant directories, oldest first
+func (m *Manager) ListArchives() ([]domain.Archive, error) {
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read tenants root: %w", err)
+	}
+
+	archives := []domain.Archive{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := domain.ParseArchiveName(e.Name()); err != nil {
+			continue
+		}
+		a, err := m.GetArchive(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		archives = append(archives, *a)
+	}
+
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].ArchivedAt.Before(archives[j].ArchivedAt)
+	})
+	return archives, nil
+}
+
+// GetArchive describes an archive. A missing archive is reported as
+// os.ErrNotExist.
+func (m *Manager) GetArchive(name string) (*domain.Archive, error) {
+	path, subdomain, err := m.archivePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("archive %s: %w", name, os.ErrNotExist)
+	}
+
+	a := &domain.Archive{Name: name, Subdomain: subdomain, ArchivedAt: info.ModTime().UTC()}
+	data, err := os.ReadFile(filepath.Join(path, archiveMetaFile))
+	switch {
+	case err == nil:
+		var meta archiveMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("failed to parse metadata of archive %s: %w", name, err)
+		}
+		a.ArchivedAt = meta.ArchivedAt
+		a.RetainedVolumes = meta.RetainedVolumes
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to read metadata of archive %s: %w", name, err)
+	}
+
+	if a.SizeBytes, err = dirSize(path); err != nil {
+		return nil, fmt.Errorf("failed to size archive %s: %w", name, err)
+	}
+	if a.VolumeBackups, err = volumeBackups(path); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// RestoreArchive moves an archive back to the directory of its tenant and
+// returns the subdomain. It fails with ErrTenantExists when the tenant has
+// an active directory.
+func (m *Manager) RestoreArchive(name string) (string, error) {
+	path, subdomain, err := m.archivePath(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+
+	target, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return "", ErrTenantExists
+	}
+
+	if err := os.Rename(path, target); err != nil {
+		return "", fmt.Errorf("failed to restore archive: %w", err)
+	}
+	if err := os.Remove(filepath.Join(target, archiveMetaFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return subdomain, fmt.Errorf("failed to remove archive metadata: %w", err)
+	}
+	return subdomain, nil
+}
+
+// RemoveArchive deletes an archive
+func (m *Manager) RemoveArchive(name string) error {
+	path, _, err := m.archivePath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// archivePath validates an archive name and returns its path and subdomain
+func (m *Manager) archivePath(name string) (string, string, error) {
+	subdomain, err := domain.ParseArchiveName(name)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(m.root, name), subdomain, nil
+}
+
+// writeArchiveMeta stores the metadata of the archive at dir
+func writeArchiveMeta(dir string, meta archiveMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, archiveMetaFile), data, 0644)
+}
+
+// dirSize returns the total size of the regular files under dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,139 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qate/q8-agent/internal/secure"
+)
+
+const (
+	// envFile is read by docker compose from the project directory
+	envFile = ".env"
+	// sealedEnvFile holds the encrypted env content when a master key is set
+	sealedEnvFile = ".env.enc"
+)
+
+// MaterializeEnv decrypts the stored env content of a tenant into a 0600 .env
+// file for the duration of a compose command. The returned function removes
+// it again. Tenants stored in cleartext are left untouched.
+func (m *Manager) MaterializeEnv(subdomain string) (func(), error) {
+	dir, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, sealedEnvFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", sealedEnvFile, err)
+	}
+
+	plain, err := m.cipher.Open(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", sealedEnvFile, err)
+	}
+
+	path := filepath.Join(dir, envFile)
+	if err := writePrivate(path, plain); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", envFile, err)
+	}
+	return func() { os.Remove(path) }, nil
+}
+
+// RekeyEnvFiles re-encrypts the env content of every tenant directory, active
+// or archived, from oldKey to newKey. Either may be nil for cleartext. It
+// returns the number of directories rewritten.
+func (m *Manager) RekeyEnvFiles(oldKey, newKey *secure.Cipher) (int, error) {
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	count := 0
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		dir := filepath.Join(m.root, e.Name())
+		for _, d := range []string{dir, filepath.Join(dir, snapshotDir)} {
+			changed, err := rekeyEnv(d, oldKey, newKey)
+			if err != nil {
+				return count, fmt.Errorf("%s: %w", d, err)
+			}
+			if changed && d == dir {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// writeEnv stores env content in dir, encrypted when the manager has a key
+func (m *Manager) writeEnv(dir string, env []byte) error {
+	return writeEnvWith(dir, env, m.cipher)
+}
+
+// rekeyEnv rewrites the env content of dir under newKey. The encrypted file
+// wins over a cleartext one, which may be a leftover of MaterializeEnv.
+// Content that only opens with newKey is rewritten as well.
+func rekeyEnv(dir string, oldKey, newKey *secure.Cipher) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, sealedEnvFile))
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = os.ReadFile(filepath.Join(dir, envFile))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	plain, err := oldKey.Open(data)
+	if err != nil {
+		// An interrupted run may already have rewritten it under newKey
+		var newErr error
+		if plain, newErr = newKey.Open(data); newErr != nil {
+			return false, err
+		}
+	}
+	return true, writeEnvWith(dir, plain, newKey)
+}
+
+// writeEnvWith stores env content in dir, sealed with c when it holds a key,
+// and removes the file of the other form
+func writeEnvWith(dir string, env []byte, c *secure.Cipher) error {
+	name, stale := envFile, sealedEnvFile
+	if c.Enabled() {
+		name, stale = sealedEnvFile, envFile
+	}
+
+	data, err := c.Seal(env)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w", envFile, err)
+	}
+	if err := writePrivate(filepath.Join(dir, name), data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := os.Remove(filepath.Join(dir, stale)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %w", stale, err)
+	}
+	return nil
+}
+
+// writePrivate writes data to path with mode 0600, also tightening the mode
+// of an existing file
+func writePrivate(path string, data []byte) error {
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
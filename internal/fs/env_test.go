@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/qate/q8-agent/internal/secure"
+)
+
+func newTestCipher(t *testing.T) *secure.Cipher {
+	t.Helper()
+	key := make([]byte, secure.KeySize)
+	rand.Read(key)
+	c, err := secure.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRekeyEnvResumes(t *testing.T) {
+	oldKey, newKey := newTestCipher(t), newTestCipher(t)
+	dir := t.TempDir()
+	env := []byte("A=1\n")
+	if err := writeEnvWith(dir, env, oldKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second run sees the content already under newKey
+	for run := 1; run <= 2; run++ {
+		changed, err := rekeyEnv(dir, oldKey, newKey)
+		if err != nil || !changed {
+			t.Fatalf("run %d: changed = %t, err = %v", run, changed, err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, sealedEnvFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := newKey.Open(data)
+	if err != nil || !bytes.Equal(plain, env) {
+		t.Fatalf("content = %q, %v, want %q under the new key", plain, err, env)
+	}
+
+	if _, err := rekeyEnv(dir, newTestCipher(t), newTestCipher(t)); err == nil {
+		t.Error("rekey with unrelated keys succeeded")
+	}
+}
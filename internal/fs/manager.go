@@ -2,51 +2,65 @@ package fs
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+	"github.com/qate/q8-agent/internal/secure"
 )
 
 // Manager handles file system operations for tenants
 type Manager struct {
-	root string
+	root   string
+	cipher *secure.Cipher
 }
 
-// NewManager creates a new file system manager
-func NewManager(root string) *Manager {
-	return &Manager{root: root}
+// NewManager creates a new file system manager. When c holds a key, tenant
+// .env files are stored encrypted.
+func NewManager(root string, c *secure.Cipher) *Manager {
+	return &Manager{root: root, cipher: c}
 }
 
 // PrepareTenantDir creates the tenant directory and returns its path
 func (m *Manager) PrepareTenantDir(subdomain string) (string, error) {
-	path := filepath.Join(m.root, subdomain)
-	err := os.MkdirAll(path, 0755)
+	path, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(path, 0755)
 	if err != nil {
 		return "", fmt.Errorf("failed to create tenant directory: %w", err)
 	}
 	return path, nil
 }
 
-// WriteConfig write the docker-compose and .env files
+// WriteConfig write the docker-compose and .env files. With a master key the
+// env content is only stored encrypted, see MaterializeEnv.
 func (m *Manager) WriteConfig(subdomain, compose, env string) error {
-	dir := filepath.Join(m.root, subdomain)
-
-	err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(compose), 0644)
+	dir, err := m.GetTenantPath(subdomain)
 	if err != nil {
-		return fmt.Errorf("failed to write docker-compose.yml: %w", err)
+		return err
 	}
 
-	err = os.WriteFile(filepath.Join(dir, ".env"), []byte(env), 0644)
+	err = os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(compose), 0644)
 	if err != nil {
-		return fmt.Errorf("failed to write .env: %w", err)
+		return fmt.Errorf("failed to write docker-compose.yml: %w", err)
 	}
 
-	return nil
+	return m.writeEnv(dir, []byte(env))
 }
 
-// ArchiveTenantDir renames the tenant directory with a UUID suffix
-func (m *Manager) ArchiveTenantDir(subdomain string) (string, error) {
-	oldPath := m.GetTenantPath(subdomain)
+// ArchiveTenantDir renames the tenant directory with a UUID suffix and
+// records the archive metadata, including the volumes kept for it
+func (m *Manager) ArchiveTenantDir(subdomain string, retainedVolumes []string) (string, error) {
+	oldPath, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return "", err
+	}
 
 	// Check if directory exists
 	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
@@ -66,18 +80,70 @@ func (m *Manager) ArchiveTenantDir(subdomain string) (string, error) {
 		return "", fmt.Errorf("failed to archive directory: %w", err)
 	}
 
+	meta := archiveMeta{Subdomain: subdomain, ArchivedAt: time.Now().UTC(), RetainedVolumes: retainedVolumes}
+	if err := writeArchiveMeta(newPath, meta); err != nil {
+		return newDirName, fmt.Errorf("failed to write archive metadata: %w", err)
+	}
+
 	return newDirName, nil
 }
 
 // RemoveTenantDir deletes the tenant directory
 func (m *Manager) RemoveTenantDir(subdomain string) error {
-	path := m.GetTenantPath(subdomain)
+	path, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return err
+	}
 	return os.RemoveAll(path)
 }
 
-// GetTenantPath returns the absolute path for a tenant
-func (m *Manager) GetTenantPath(subdomain string) string {
-	return filepath.Join(m.root, subdomain)
+// ListTenants returns the subdomains of the active tenant directories,
+// skipping archives and anything that is not a valid tenant identifier
+func (m *Manager) ListTenants() ([]string, error) {
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read tenants root: %w", err)
+	}
+
+	var subdomains []string
+	for _, e := range entries {
+		if e.IsDir() && domain.ValidateSubdomain(e.Name()) == nil {
+			subdomains = append(subdomains, e.Name())
+		}
+	}
+	return subdomains, nil
+}
+
+// GetTenantPath returns the absolute path for a tenant. The subdomain is
+// validated so the path can never escape the tenants root.
+func (m *Manager) GetTenantPath(subdomain string) (string, error) {
+	if err := domain.ValidateSubdomain(subdomain); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(m.root, subdomain)
+	if rel, err := filepath.Rel(m.root, path); err != nil || rel != subdomain {
+		return "", fmt.Errorf("tenant path %s escapes tenants root", path)
+	}
+	return path, nil
+}
+
+// TenantExists reports whether the directory of a tenant exists
+func (m *Manager) TenantExists(subdomain string) (bool, error) {
+	dir, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
 }
 
 // newUUID generates a random UUID (version 4)
@@ -0,0 +1,106 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// snapshotDir holds the previous config files while a provision is in progress
+const snapshotDir = ".q8-snapshot"
+
+// configFiles are the tenant files covered by snapshots
+var configFiles = []string{"docker-compose.yml", envFile, sealedEnvFile}
+
+// SnapshotConfig copies the current config files of a tenant aside so they can
+// be restored if the new configuration fails. It reports whether a previous
+// configuration existed.
+func (m *Manager) SnapshotConfig(subdomain string) (bool, error) {
+	dir, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, configFiles[0])); errors.Is(err, os.ErrNotExist) {
+		return false, nil // New tenant, nothing to snapshot
+	}
+
+	snapDir := filepath.Join(dir, snapshotDir)
+	if err := os.RemoveAll(snapDir); err != nil {
+		return false, fmt.Errorf("failed to clear previous snapshot: %w", err)
+	}
+	if err := os.Mkdir(snapDir, 0700); err != nil {
+		return false, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	for _, name := range configFiles {
+		err := copyFile(filepath.Join(dir, name), filepath.Join(snapDir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("failed to snapshot %s: %w", name, err)
+		}
+	}
+	return true, nil
+}
+
+// RestoreConfig puts back the config files saved by SnapshotConfig
+func (m *Manager) RestoreConfig(subdomain string) error {
+	dir, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return err
+	}
+
+	snapDir := filepath.Join(dir, snapshotDir)
+	for _, name := range configFiles {
+		err := copyFile(filepath.Join(snapDir, name), filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			// Absent from the snapshot means absent before the provision
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove %s: %w", name, err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// RemoveConfig removes the config files of a tenant, such as those left by
+// a provision that failed to write them all
+func (m *Manager) RemoveConfig(subdomain string) error {
+	dir, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range configFiles {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// DiscardSnapshot removes the snapshot once the new configuration is in place
+func (m *Manager) DiscardSnapshot(subdomain string) error {
+	dir, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(dir, snapshotDir))
+}
+
+// copyFile copies src to dst, preserving the permission bits of src
+func copyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, info.Mode().Perm())
+}
@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// volumeBackupDir holds the volume backups of a tenant, archived with it
+const volumeBackupDir = "volumes"
+
+// volumeBackupExt is the extension of volume backup files
+const volumeBackupExt = ".tar.gz"
+
+// CreateVolumeBackup creates the backup file of a volume in the tenant
+// directory, creating the directory if the tenant was already archived. The
+// file is private to the agent; the caller must close it.
+func (m *Manager) CreateVolumeBackup(subdomain, volume string) (io.WriteCloser, error) {
+	if err := checkVolumeName(volume); err != nil {
+		return nil, err
+	}
+
+	dir, err := m.PrepareTenantDir(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, volumeBackupDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, volume+volumeBackupExt), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create volume backup: %w", err)
+	}
+	return f, nil
+}
+
+// VolumeBackups returns the names of the volumes backed up in the tenant
+// directory, sorted
+func (m *Manager) VolumeBackups(subdomain string) ([]string, error) {
+	dir, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	return volumeBackups(dir)
+}
+
+// OpenVolumeBackup opens the backup of a volume in the tenant directory. The
+// caller must close it.
+func (m *Manager) OpenVolumeBackup(subdomain, volume string) (io.ReadCloser, error) {
+	if err := checkVolumeName(volume); err != nil {
+		return nil, err
+	}
+	dir, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(dir, volumeBackupDir, volume+volumeBackupExt))
+}
+
+// RemoveVolumeBackups deletes the volume backups of the tenant directory
+func (m *Manager) RemoveVolumeBackups(subdomain string) error {
+	dir, err := m.GetTenantPath(subdomain)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(dir, volumeBackupDir))
+}
+
+// volumeBackups lists the volume backups found under dir
+func volumeBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, volumeBackupDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list volume backups: %w", err)
+	}
+
+	var volumes []string
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), volumeBackupExt); ok && e.Type().IsRegular() {
+			volumes = append(volumes, name)
+		}
+	}
+	return volumes, nil
+}
+
+// checkVolumeName rejects volume names that cannot be used as file names
+func checkVolumeName(volume string) error {
+	if volume == "" || volume != filepath.Base(volume) || strings.HasPrefix(volume, ".") {
+		return fmt.Errorf("invalid volume name %q", volume)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+// Package metrics keeps counters, gauges and histograms and renders them in
+// the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of latency histograms
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// OperationBuckets are the upper bounds, in seconds, of histograms of long
+// running operations such as pulls and compose up
+var OperationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800}
+
+// Registry holds the metrics of the agent
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	scrapers []func(ctx context.Context)
+
+	// scrape serializes the scrapers, which reset and fill gauges
+	scrape sync.Mutex
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// family is a metric and its series, one per set of label values
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series holds the value of a metric for one set of label values
+type series struct {
+	values []string
+	value  float64
+	// Histograms only: counts per bucket, not cumulative, and the sum
+	counts []uint64
+	sum    float64
+}
+
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *family {
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, other := range r.families {
+		if other.name == name {
+			panic("metrics: duplicate metric " + name)
+		}
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+// get returns the series of the label values, created on first use. The
+// caller must hold f.mu.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: slices.Clone(values)}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a monotonically increasing metric. A nil Counter ignores
+// updates, so components work without metrics.
+type Counter struct{ f *family }
+
+// Counter registers a counter with the given label names
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+// Inc adds one to the series of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, which must not be negative, to the series of the label values
+func (c *Counter) Add(v float64, values ...string) {
+	if c == nil {
+		return
+	}
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.get(values).value += v
+}
+
+// Gauge is a metric that can go up and down. A nil Gauge ignores updates.
+type Gauge struct{ f *family }
+
+// Gauge registers a gauge with the given label names
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", nil, labels)}
+}
+
+// Set sets the series of the label values to v
+func (g *Gauge) Set(v float64, values ...string) {
+	if g == nil {
+		return
+	}
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.get(values).value = v
+}
+
+// Reset drops every series, so that label values no longer set disappear
+func (g *Gauge) Reset() {
+	if g == nil {
+		return
+	}
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	clear(g.f.series)
+}
+
+// Histogram counts observations in buckets. A nil Histogram ignores
+// observations.
+type Histogram struct{ f *family }
+
+// Histogram registers a histogram with the given bucket upper bounds, sorted
+// in increasing order, and label names
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 || !slices.IsSorted(buckets) {
+		panic("metrics: histogram " + name + " needs sorted buckets")
+	}
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+// Observe records v in the series of the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	if h == nil {
+		return
+	}
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(values)
+	if i, _ := slices.BinarySearch(h.f.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.value++
+	s.sum += v
+}
+
+// OnScrape registers fn to run before every rendering, to set the gauges
+// computed from the current state
+func (r *Registry) OnScrape(fn func(ctx context.Context)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scrapers = append(r.scrapers, fn)
+}
+
+// WriteText runs the scrapers and writes every metric to w in the Prometheus
+// text format, series sorted by label values
+func (r *Registry) WriteText(ctx context.Context, w io.Writer) error {
+	r.scrape.Lock()
+	defer r.scrape.Unlock()
+
+	r.mu.Lock()
+	scrapers := slices.Clone(r.scrapers)
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+
+	for _, fn := range scrapers {
+		fn(ctx)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.buckets == nil {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelSet(s.values, ""), formatValue(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelSet(s.values, formatValue(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %s\n", f.name, f.labelSet(s.values, "+Inf"), formatValue(s.value))
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labelSet(s.values, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", f.name, f.labelSet(s.values, ""), formatValue(s.value))
+	}
+}
+
+// labelSet renders the labels of a series, with the le label of a histogram
+// bucket when le is set
+func (f *family) labelSet(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range f.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	if le != "" {
+		if len(values) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "le=\"%s\"", le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,123 @@
+// Package secure encrypts agent data at rest with AES-256-GCM under an
+// optional master key, and loads the TLS configuration of the API
+package secure
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of a master key: AES-256
+const KeySize = 32
+
+// sealedPrefix marks encrypted content; the rest is base64(nonce|ciphertext)
+var sealedPrefix = []byte("q8enc:v1:")
+
+// ErrNoKey is returned when encrypted content is read without a master key
+var ErrNoKey = errors.New("content is encrypted but no master key is configured")
+
+// Cipher seals and opens content with a master key. A nil *Cipher is valid
+// and leaves content in cleartext, so callers need not special-case a
+// missing key.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher creates a cipher from a 32-byte key
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// LoadKey creates a cipher from a base64-encoded key given directly or stored
+// in file. It returns nil when neither is set, meaning encryption is disabled.
+func LoadKey(value, file string) (*Cipher, error) {
+	if value != "" && file != "" {
+		return nil, errors.New("master key and master key file are mutually exclusive")
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %w", err)
+		}
+		value = string(data)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("master key must be base64-encoded: %w", err)
+	}
+	return NewCipher(key)
+}
+
+// Enabled reports whether c encrypts content
+func (c *Cipher) Enabled() bool {
+	return c != nil
+}
+
+// Seal encrypts plain. Without a key it returns plain unchanged.
+func (c *Cipher) Seal(plain []byte) ([]byte, error) {
+	if c == nil {
+		return plain, nil
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, plain, nil)
+
+	out := make([]byte, 0, len(sealedPrefix)+base64.StdEncoding.EncodedLen(len(sealed)))
+	out = append(out, sealedPrefix...)
+	return base64.StdEncoding.AppendEncode(out, sealed), nil
+}
+
+// Open decrypts content produced by Seal. Cleartext content is returned
+// unchanged, which lets stores written before a key was configured be read.
+func (c *Cipher) Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	if c == nil {
+		return nil, ErrNoKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data[len(sealedPrefix):])))
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted content: %w", err)
+	}
+	n := c.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("malformed encrypted content: too short")
+	}
+	plain, err := c.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt content: wrong master key or corrupted data")
+	}
+	return plain, nil
+}
+
+// IsSealed reports whether data was produced by Seal
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedPrefix)
+}
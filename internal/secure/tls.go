@@ -0,0 +1,81 @@
+package secure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// TLSReloader serves the agent certificate and, for mutual TLS, verifies
+// client certificates against a CA bundle. Reload reads the files again so
+// that rotated certificates apply to new connections without a restart.
+type TLSReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	config atomic.Pointer[tls.Config]
+}
+
+// NewTLSReloader loads the server certificate and key, and the client CA
+// bundle when caFile is set
+func NewTLSReloader(certFile, keyFile, caFile string) (*TLSReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS needs both a certificate and a key file")
+	}
+
+	r := &TLSReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate, key and CA files. The previous configuration
+// stays in use when they cannot be loaded.
+func (r *TLSReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in client CA file %s", r.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.config.Store(config)
+	return nil
+}
+
+// MutualTLS reports whether client certificates are required
+func (r *TLSReloader) MutualTLS() bool {
+	return r.caFile != ""
+}
+
+// TLSConfig returns the server configuration, which picks up the files
+// loaded by the latest successful Reload for every handshake
+func (r *TLSReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.config.Load(), nil
+		},
+	}
+}
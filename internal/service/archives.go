@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+	"github.com/qate/q8-agent/internal/fs"
+)
+
+// ErrArchiveNotFound is returned for unknown archives
+var ErrArchiveNotFound = domain.NewError(domain.CodeNotFound, "archive not found")
+
+// errTenantExists is returned when restoring an archive of an existing tenant
+var errTenantExists = domain.NewError(domain.CodeConflict, "tenant exists, tear it down before restoring an archive")
+
+// ListArchives returns the archived tenant directories, oldest first, only
+// those of subdomain when it is not empty
+func (s *Orchestrator) ListArchives(subdomain string) ([]domain.Archive, error) {
+	archives, err := s.fs.ListArchives()
+	if err != nil {
+		return nil, err
+	}
+	if subdomain != "" {
+		archives = slices.DeleteFunc(archives, func(a domain.Archive) bool { return a.Subdomain != subdomain })
+	}
+	return archives, nil
+}
+
+// GetArchive describes an archive
+func (s *Orchestrator) GetArchive(name string) (*domain.Archive, error) {
+	a, err := s.fs.GetArchive(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrArchiveNotFound
+	}
+	return a, err
+}
+
+// RestoreArchive moves an archive back in place of its torn down tenant,
+// recreates the volumes backed up in it, and starts the stack again. Tenants
+// the registry does not know, such as purged ones, are registered.
+func (s *Orchestrator) RestoreArchive(ctx context.Context, name string) (result *domain.ArchiveRestoreResult, err error) {
+	subdomain, err := domain.ParseArchiveName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := s.lock(ctx, subdomain, domain.JobRestore)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := s.admit(subdomain, domain.JobRestore); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Restoring archive %s of tenant: %s", name, subdomain)
+
+	// 1. Move the config back
+	reportStep(ctx, "restoring directory")
+	if _, err := s.fs.RestoreArchive(name); err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return nil, ErrArchiveNotFound
+		case errors.Is(err, fs.ErrTenantExists):
+			return nil, errTenantExists
+		}
+		return nil, fmt.Errorf("fs restore error: %w", err)
+	}
+
+	// From here on the tenant directory is back: failures leave it failed
+	defer func() {
+		s.record(subdomain, domain.JobRestore, err, func(rec *domain.TenantRecord) {
+			if err != nil {
+				rec.State = domain.TenantFailed
+				return
+			}
+			rec.State = domain.TenantActive
+			rec.Archive = ""
+			rec.RetainedVolumes = nil
+		})
+	}()
+
+	project := fmt.Sprintf("q8-%s", subdomain)
+	dir, err := s.fs.GetTenantPath(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	result = &domain.ArchiveRestoreResult{Archive: name, Subdomain: subdomain}
+
+	// 2. Recreate the backed up volumes that do not exist anymore
+	backups, err := s.fs.VolumeBackups(subdomain)
+	if err != nil {
+		return nil, fmt.Errorf("fs backup error: %w", err)
+	}
+	if len(backups) > 0 {
+		existing, err := s.docker.ComposeVolumes(ctx, project)
+		if err != nil {
+			return nil, engineError("docker volumes error", err)
+		}
+		for _, v := range backups {
+			if slices.Contains(existing, v) {
+				log.Printf("Warning: volume %s exists, not restoring its backup", v)
+				continue
+			}
+			reportStep(ctx, fmt.Sprintf("restoring volume %s", v))
+			if err := s.restoreVolume(ctx, subdomain, project, v); err != nil {
+				return nil, err
+			}
+			result.RestoredVolumes = append(result.RestoredVolumes, v)
+		}
+	}
+
+	// 3. Start the stack with the images it ran before where still present
+	reportStep(ctx, "starting containers")
+	out, err := s.compose(subdomain, func() ([]byte, error) { return s.docker.ExecuteComposeUpCached(ctx, project, dir) })
+	reportOutput(ctx, out)
+	if err != nil {
+		return nil, composeError(domain.CodeComposeFailed, "docker up error", out, err)
+	}
+
+	if len(backups) > 0 {
+		if err := s.fs.RemoveVolumeBackups(subdomain); err != nil {
+			log.Printf("Warning: failed to remove volume backups of %s: %s", subdomain, err)
+		}
+	}
+
+	reportResult(ctx, result)
+	log.Printf("Archive %s restored to tenant %s", name, subdomain)
+	return result, nil
+}
+
+// restoreVolume recreates a volume from its backup in the tenant directory
+func (s *Orchestrator) restoreVolume(ctx context.Context, subdomain, project, volume string) error {
+	r, err := s.fs.OpenVolumeBackup(subdomain, volume)
+	if err != nil {
+		return fmt.Errorf("fs backup error: %w", err)
+	}
+	defer r.Close()
+
+	if err := s.docker.RestoreVolume(ctx, project, volume, r); err != nil {
+		return domain.WrapError(domain.CodeDockerError, "volume restore error", err)
+	}
+	return nil
+}
+
+// PurgeArchive deletes an archive. The volumes retained with it and the
+// tenant secrets are removed as well, unless the tenant was provisioned again
+// and uses them.
+func (s *Orchestrator) PurgeArchive(ctx context.Context, name string) (result *domain.ArchivePurgeResult, err error) {
+	subdomain, err := domain.ParseArchiveName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := s.lock(ctx, subdomain, domain.JobPurge)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	archive, err := s.GetArchive(name)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Purging archive %s of tenant: %s", name, subdomain)
+
+	result = &domain.ArchivePurgeResult{Archive: name}
+	rec, known := s.registry.Get(subdomain)
+	// A tenant directory means the tenant was provisioned again, maybe with
+	// these volumes; keep them as well when that cannot be checked
+	exists, statErr := s.fs.TenantExists(subdomain)
+	inUse := statErr != nil || exists || known && (rec.State != domain.TenantTornDown || rec.Archive != name)
+	if len(archive.RetainedVolumes) > 0 {
+		if inUse {
+			result.KeptVolumes = archive.RetainedVolumes
+		} else {
+			for _, v := range archive.RetainedVolumes {
+				if err := s.docker.RemoveVolume(ctx, v); err != nil {
+					return nil, engineError(fmt.Sprintf("failed to remove volume %s", v), err)
+				}
+				result.RemovedVolumes = append(result.RemovedVolumes, v)
+			}
+		}
+	}
+
+	if err := s.fs.RemoveArchive(name); err != nil {
+		return nil, fmt.Errorf("fs remove error: %w", err)
+	}
+	if !inUse {
+		if err := s.secrets.Delete(subdomain); err != nil {
+			return nil, fmt.Errorf("secret store error: %w", err)
+		}
+	}
+
+	if known && rec.Archive == name {
+		s.record(subdomain, domain.JobPurge, nil, func(rec *domain.TenantRecord) {
+			rec.Archive = ""
+			rec.RetainedVolumes = nil
+		})
+	}
+	return result, nil
+}
+
+// PruneArchives purges the archives made before cutoff. It returns the
+// number of archives purged; archives that fail are logged and skipped.
+func (s *Orchestrator) PruneArchives(ctx context.Context, cutoff time.Time) (int, error) {
+	archives, err := s.fs.ListArchives()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, a := range archives {
+		if !a.ArchivedAt.Before(cutoff) {
+			continue
+		}
+		if _, err := s.PurgeArchive(ctx, a.Name); err != nil {
+			log.Printf("Warning: failed to purge expired archive %s: %s", a.Name, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// RunArchiveJanitor purges the archives older than retention every interval
+// until ctx is done
+func (s *Orchestrator) RunArchiveJanitor(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := s.PruneArchives(ctx, time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Warning: archive janitor: %s", err)
+		} else if n > 0 {
+			log.Printf("Archive janitor purged %d archive(s) older than %s", n, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package service_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+func TestPurgeArchive(t *testing.T) {
+	volumes := []string{"q8-acme_data"}
+	tests := []struct {
+		name      string
+		tenantDir bool
+		kept      []string
+		removed   []string
+	}{
+		{name: "unused volumes", removed: volumes},
+		{name: "tenant directory exists", tenantDir: true, kept: volumes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			ctx := context.Background()
+			if err := e.provision(t, "acme", testCompose); err != nil {
+				t.Fatal(err)
+			}
+			e.backend.SetVolumes("q8-acme", volumes...)
+			teardown, err := e.o.TeardownTenant(ctx, "acme", domain.TeardownKeepVolumes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tenantDir {
+				if err := os.Mkdir(filepath.Join(e.root, "acme"), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := e.o.PurgeArchive(ctx, filepath.Base(teardown.Archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(result.KeptVolumes, tt.kept) || !slices.Equal(result.RemovedVolumes, tt.removed) {
+				t.Errorf("result = %+v, want kept %v and removed %v", result, tt.kept, tt.removed)
+			}
+			if removed := e.called("RemoveVolume", "q8-acme_data"); removed != (tt.removed != nil) {
+				t.Errorf("volume removed = %t", removed)
+			}
+			if _, err := os.Stat(filepath.Join(e.root, teardown.Archive)); !os.IsNotExist(err) {
+				t.Errorf("archive still exists: %v", err)
+			}
+		})
+	}
+}
+
+func TestRestoreArchiveRegistersUnknownTenant(t *testing.T) {
+	old := newTestEnv(t)
+	ctx := context.Background()
+	if err := old.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+	teardown, err := old.o.TeardownTenant(ctx, "acme", domain.TeardownKeepVolumes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An agent with an empty registry finds the archive on disk
+	e := newTestEnv(t)
+	name := filepath.Base(teardown.Archive)
+	if err := os.Rename(filepath.Join(old.root, teardown.Archive), filepath.Join(e.root, name)); err != nil {
+		t.Fatal(err)
+	}
+	e.backend.SetServices("q8-acme", "web")
+
+	if _, err := e.o.RestoreArchive(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.state(t, "acme"); got != domain.TenantActive {
+		t.Errorf("state = %s, want %s", got, domain.TenantActive)
+	}
+}
+
+func TestPurgeArchiveForgetsSecrets(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	provision := func() string {
+		t.Helper()
+		e.backend.SetServices("q8-acme", "web")
+		err := e.o.ProvisionTenant(ctx, domain.TenantProvisionRequest{
+			ID:             "id-acme",
+			Subdomain:      "acme",
+			ComposeContent: testCompose,
+			EnvContent:     "DB_PASSWORD=${q8:secret:DB_PASSWORD}\n",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readFile(t, filepath.Join(e.root, "acme", ".env"))
+	}
+
+	first := provision()
+	teardown, err := e.o.TeardownTenant(ctx, "acme", domain.TeardownKeepVolumes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.o.PurgeArchive(ctx, filepath.Base(teardown.Archive)); err != nil {
+		t.Fatal(err)
+	}
+	if second := provision(); second == first {
+		t.Errorf("re-provision after an archive purge reused the secret: %q", second)
+	}
+}
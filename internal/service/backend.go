@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"io"
+
+	"github.com/qate/q8-agent/internal/docker"
+	"github.com/qate/q8-agent/internal/domain"
+	"github.com/qate/q8-agent/internal/fs"
+	"github.com/qate/q8-agent/internal/state"
+)
+
+// ComposeBackend runs container operations for a compose project
+type ComposeBackend interface {
+	ExecuteComposeUp(ctx context.Context, project, dir string) ([]byte, error)
+	ExecuteComposeUpCached(ctx context.Context, project, dir string) ([]byte, error)
+	ExecuteComposeUpServices(ctx context.Context, project, dir string, services []string) ([]byte, error)
+	ExecuteComposeDown(ctx context.Context, project, dir string) ([]byte, error)
+	ExecuteComposePull(ctx context.Context, project, dir string) ([]byte, error)
+	ComposeRestart(ctx context.Context, project string, services ...string) error
+	ComposeStop(ctx context.Context, project string) (stopped []string, err error)
+	ComposeStart(ctx context.Context, project string, names []string) error
+	ComposePs(ctx context.Context, project string) ([]docker.ServiceContainer, error)
+	ComposeServices(ctx context.Context, project string) ([]string, error)
+	ComposeLogs(ctx context.Context, project string, opts docker.ComposeLogsOptions, dst io.Writer) error
+	ComposeImages(ctx context.Context, project string) ([]docker.ServiceImage, error)
+	ComposeVolumes(ctx context.Context, project string) ([]string, error)
+	RemoveVolume(ctx context.Context, name string) error
+	BackupVolume(ctx context.Context, volume string, dst io.Writer) error
+	RestoreVolume(ctx context.Context, project, volume string, src io.Reader) error
+	ImageID(ctx context.Context, ref string) (string, error)
+	ExecuteMongoScript(ctx context.Context, host, script string, env map[string]string) ([]byte, error)
+}
+
+// WorkspaceStore manages tenant directories and their config files
+type WorkspaceStore interface {
+	PrepareTenantDir(subdomain string) (string, error)
+	WriteConfig(subdomain, compose, env string) error
+	MaterializeEnv(subdomain string) (cleanup func(), err error)
+	SnapshotConfig(subdomain string) (bool, error)
+	RestoreConfig(subdomain string) error
+	RemoveConfig(subdomain string) error
+	DiscardSnapshot(subdomain string) error
+	ArchiveTenantDir(subdomain string, retainedVolumes []string) (string, error)
+	RemoveTenantDir(subdomain string) error
+	CreateVolumeBackup(subdomain, volume string) (io.WriteCloser, error)
+	VolumeBackups(subdomain string) ([]string, error)
+	OpenVolumeBackup(subdomain, volume string) (io.ReadCloser, error)
+	RemoveVolumeBackups(subdomain string) error
+	ListArchives() ([]domain.Archive, error)
+	GetArchive(name string) (*domain.Archive, error)
+	RestoreArchive(name string) (subdomain string, err error)
+	RemoveArchive(name string) error
+	GetTenantPath(subdomain string) (string, error)
+	TenantExists(subdomain string) (bool, error)
+	ListTenants() ([]string, error)
+}
+
+// TenantRegistry persists what the agent knows about the tenants it manages
+type TenantRegistry interface {
+	Get(subdomain string) (domain.TenantRecord, bool)
+	Update(subdomain string, fn func(rec *domain.TenantRecord)) (domain.TenantRecord, error)
+	List(filter domain.TenantFilter) ([]domain.TenantRecord, int)
+}
+
+// SecretStore keeps generated tenant secrets stable across provisions
+type SecretStore interface {
+	Ensure(subdomain string, names []string) (values map[string]string, pending []string, err error)
+	Confirm(subdomain string, names []string) error
+	Delete(subdomain string) error
+}
+
+var (
+	_ ComposeBackend = (*docker.Runner)(nil)
+	_ WorkspaceStore = (*fs.Manager)(nil)
+	_ TenantRegistry = (*state.Store)(nil)
+	_ SecretStore    = (*state.SecretStore)(nil)
+)
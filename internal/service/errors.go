@@ -0,0 +1,42 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/qate/q8-agent/internal/docker"
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// maxErrorOutput caps the command output attached to an error, keeping the tail
+const maxErrorOutput = 4096
+
+// composeError describes a failed docker CLI command. Its output is kept in
+// the error details rather than the message. Failures to reach the daemon are
+// reported as CodeDockerUnavailable whatever the command.
+func composeError(code domain.ErrorCode, message string, out []byte, err error) error {
+	if docker.IsDaemonDown(out) {
+		code = domain.CodeDockerUnavailable
+	}
+	if len(out) > maxErrorOutput {
+		out = out[len(out)-maxErrorOutput:]
+	}
+	return &domain.Error{
+		Code:    code,
+		Message: message,
+		Details: map[string]string{"output": string(out)},
+		Err:     err,
+	}
+}
+
+// engineError describes a failed Docker Engine API call. Acting on a project
+// without containers is reported as CodeConflict.
+func engineError(message string, err error) error {
+	code := domain.CodeDockerError
+	switch {
+	case docker.IsUnreachable(err):
+		code = domain.CodeDockerUnavailable
+	case errors.Is(err, docker.ErrNoContainers):
+		code = domain.CodeConflict
+	}
+	return domain.WrapError(code, message, err)
+}
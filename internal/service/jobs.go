@@ -0,0 +1,312 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+	"github.com/qate/q8-agent/internal/metrics"
+)
+
+// maxJobOutput caps the captured compose output per job, keeping the tail
+const maxJobOutput = 256 * 1024
+
+var (
+	// ErrQueueFull is returned when no more jobs can be accepted
+	ErrQueueFull = domain.NewError(domain.CodeQueueFull, "job queue is full")
+	// ErrShuttingDown is returned when jobs are submitted during shutdown
+	ErrShuttingDown = domain.NewError(domain.CodeShuttingDown, "job manager is shutting down")
+)
+
+// JobFunc is the work run by a job. Progress is reported through ctx.
+type JobFunc func(ctx context.Context) error
+
+// job is the mutable state behind a domain.Job
+type job struct {
+	mu   sync.Mutex
+	info domain.Job
+	fn   JobFunc
+	// secretResult becomes the result if the job succeeds, then claimOnce
+	// makes Claim drop it once read
+	secretResult any
+	claimOnce    bool
+}
+
+func (j *job) snapshot() domain.Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.info
+}
+
+func (j *job) update(fn func(info *domain.Job)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.info)
+}
+
+// JobManager runs tenant operations asynchronously on a fixed worker pool
+type JobManager struct {
+	mu        sync.Mutex
+	jobs      map[string]*job
+	queue     chan *job
+	retention time.Duration
+	closed    bool
+
+	workers int
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	operations        *metrics.Counter
+	operationDuration *metrics.Histogram
+}
+
+// NewJobManager creates a job manager with the given number of workers,
+// queue capacity and retention of finished jobs
+func NewJobManager(workers, queueSize int, retention time.Duration) *JobManager {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobManager{
+		jobs:      make(map[string]*job),
+		queue:     make(chan *job, queueSize),
+		retention: retention,
+		workers:   workers,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Start launches the worker pool
+func (m *JobManager) Start() {
+	for i := 0; i < m.workers; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+}
+
+// Instrument counts the finished jobs in reg, by type and outcome, and
+// records how long they ran. It must be called before Start.
+func (m *JobManager) Instrument(reg *metrics.Registry) {
+	m.operations = reg.Counter("q8_operations_total",
+		"Tenant operations run by the agent, by type and outcome (succeeded or failed)", "type", "outcome")
+	m.operationDuration = reg.Histogram("q8_operation_duration_seconds",
+		"Duration of tenant operations, by type and outcome", metrics.OperationBuckets, "type", "outcome")
+}
+
+// Shutdown stops accepting jobs and waits for queued and running jobs to finish.
+// When ctx expires first, running jobs are cancelled.
+func (m *JobManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		m.cancel()
+		return nil
+	case <-ctx.Done():
+		m.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Submit queues fn as a new job and returns its initial state
+func (m *JobManager) Submit(jobType domain.JobType, subdomain string, fn JobFunc) (domain.Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	j := &job{
+		info: domain.Job{
+			ID:        id,
+			Type:      jobType,
+			Subdomain: subdomain,
+			State:     domain.JobQueued,
+			CreatedAt: time.Now().UTC(),
+		},
+		fn: fn,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return domain.Job{}, ErrShuttingDown
+	}
+	m.pruneLocked()
+
+	select {
+	case m.queue <- j:
+	default:
+		return domain.Job{}, ErrQueueFull
+	}
+	m.jobs[id] = j
+
+	log.Printf("Job %s queued: %s %s", id, jobType, subdomain)
+	return j.snapshot(), nil
+}
+
+// Get returns the current state of a job
+func (m *JobManager) Get(id string) (domain.Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pruneLocked()
+	j, ok := m.jobs[id]
+	if !ok {
+		return domain.Job{}, false
+	}
+	return j.snapshot(), true
+}
+
+// Claim returns the current state of a job for its caller to read. A result
+// set with reportSecretResult is returned by the first claim only, then
+// dropped from the job.
+func (m *JobManager) Claim(id string) (domain.Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pruneLocked()
+	j, ok := m.jobs[id]
+	if !ok {
+		return domain.Job{}, false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	info := j.info
+	if j.claimOnce {
+		j.info.Result = nil
+		j.claimOnce = false
+	}
+	return info, true
+}
+
+func (m *JobManager) worker() {
+	defer m.wg.Done()
+	for j := range m.queue {
+		m.run(j)
+	}
+}
+
+func (m *JobManager) run(j *job) {
+	j.update(func(info *domain.Job) {
+		now := time.Now().UTC()
+		info.State = domain.JobRunning
+		info.StartedAt = &now
+	})
+
+	info := j.snapshot()
+	log.Printf("Job %s started: %s %s", info.ID, info.Type, info.Subdomain)
+
+	err := j.fn(context.WithValue(m.ctx, progressKey{}, j))
+
+	var outcome domain.JobState
+	j.update(func(info *domain.Job) {
+		now := time.Now().UTC()
+		info.FinishedAt = &now
+		if err != nil {
+			info.State = domain.JobFailed
+			info.Error = err.Error()
+			info.ErrorCode = domain.CodeOf(err)
+		} else {
+			info.State = domain.JobSucceeded
+			if j.secretResult != nil {
+				info.Result = j.secretResult
+				j.claimOnce = true
+			}
+		}
+		j.secretResult = nil
+		outcome = info.State
+	})
+	m.operations.Inc(string(info.Type), string(outcome))
+	m.operationDuration.Observe(time.Since(*info.StartedAt).Seconds(), string(info.Type), string(outcome))
+
+	if err != nil {
+		log.Printf("Job %s failed: %s", info.ID, err)
+	} else {
+		log.Printf("Job %s succeeded", info.ID)
+	}
+}
+
+// pruneLocked forgets finished jobs older than the retention. The caller must hold m.mu.
+func (m *JobManager) pruneLocked() {
+	cutoff := time.Now().Add(-m.retention)
+	for id, j := range m.jobs {
+		info := j.snapshot()
+		if info.Done() && info.FinishedAt.Before(cutoff) {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// progressKey is the context key under which the running job is stored
+type progressKey struct{}
+
+// reportStep records the current step of the job running in ctx, if any
+func reportStep(ctx context.Context, step string) {
+	if j, ok := ctx.Value(progressKey{}).(*job); ok {
+		j.update(func(info *domain.Job) { info.Step = step })
+	}
+}
+
+// reportOutput appends command output to the job running in ctx, if any
+func reportOutput(ctx context.Context, out []byte) {
+	j, ok := ctx.Value(progressKey{}).(*job)
+	if !ok || len(out) == 0 {
+		return
+	}
+	j.update(func(info *domain.Job) {
+		info.Output += string(out)
+		if len(info.Output) > maxJobOutput {
+			info.Output = info.Output[len(info.Output)-maxJobOutput:]
+		}
+	})
+}
+
+// reportResult sets the structured result of the job running in ctx, if any
+func reportResult(ctx context.Context, result any) {
+	if j, ok := ctx.Value(progressKey{}).(*job); ok {
+		j.update(func(info *domain.Job) { info.Result = result })
+	}
+}
+
+// reportSecretResult sets the result of the job running in ctx like
+// reportResult, but only if the job succeeds, and for a single Claim. It
+// reports whether ctx runs a job.
+func reportSecretResult(ctx context.Context, result any) bool {
+	j, ok := ctx.Value(progressKey{}).(*job)
+	if !ok {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.secretResult = result
+	return true
+}
+
+// newJobID generates a random job identifier
+func newJobID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
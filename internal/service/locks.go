@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// LockMode decides what happens when a tenant is already locked
+type LockMode string
+
+// Supported lock modes
+const (
+	// LockReject fails immediately with a *BusyError
+	LockReject LockMode = "reject"
+	// LockQueue waits until the current holder releases the lock
+	LockQueue LockMode = "queue"
+)
+
+// BusyError is returned when a tenant is locked by another operation
+type BusyError struct {
+	Subdomain string
+	Operation string
+	Since     time.Time
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("tenant %s is busy: %s in progress since %s",
+		e.Subdomain, e.Operation, e.Since.Format(time.RFC3339))
+}
+
+// ErrorCode reports busy tenants as domain.CodeTenantBusy
+func (e *BusyError) ErrorCode() domain.ErrorCode {
+	return domain.CodeTenantBusy
+}
+
+// ErrorDetails describes the operation holding the tenant
+func (e *BusyError) ErrorDetails() any {
+	return map[string]string{
+		"subdomain": e.Subdomain,
+		"operation": e.Operation,
+		"since":     e.Since.Format(time.RFC3339),
+	}
+}
+
+// tenantLock is a held lock; done is closed on release
+type tenantLock struct {
+	op    string
+	since time.Time
+	done  chan struct{}
+}
+
+// LockManager serializes mutating operations per tenant subdomain
+type LockManager struct {
+	mu    sync.Mutex
+	mode  LockMode
+	locks map[string]*tenantLock
+}
+
+// NewLockManager creates a lock manager. Unknown modes fall back to LockReject.
+func NewLockManager(mode LockMode) *LockManager {
+	if mode != LockReject && mode != LockQueue {
+		log.Printf("Warning: unknown lock mode %q, using %q", mode, LockReject)
+		mode = LockReject
+	}
+	return &LockManager{
+		mode:  mode,
+		locks: make(map[string]*tenantLock),
+	}
+}
+
+// Mode returns the configured lock mode
+func (m *LockManager) Mode() LockMode {
+	return m.mode
+}
+
+// Acquire takes the lock of subdomain on behalf of op. In reject mode a held
+// lock yields a *BusyError; in queue mode it waits until released or ctx is done.
+func (m *LockManager) Acquire(ctx context.Context, subdomain, op string) (*Lease, error) {
+	for {
+		lease, held := m.tryAcquire(subdomain, op)
+		if lease != nil {
+			return lease, nil
+		}
+		if m.mode == LockReject {
+			return nil, &BusyError{Subdomain: subdomain, Operation: held.op, Since: held.since}
+		}
+
+		log.Printf("Tenant %s is busy (%s), %s waiting", subdomain, held.op, op)
+		select {
+		case <-held.done:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for tenant %s lock: %w", subdomain, ctx.Err())
+		}
+	}
+}
+
+// Holder returns the operation currently holding the lock of subdomain
+func (m *LockManager) Holder(subdomain string) (op string, since time.Time, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.locks[subdomain]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	return l.op, l.since, true
+}
+
+// tryAcquire returns a lease, or the current holder when the lock is taken
+func (m *LockManager) tryAcquire(subdomain, op string) (*Lease, *tenantLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if held, ok := m.locks[subdomain]; ok {
+		return nil, held
+	}
+
+	l := &tenantLock{op: op, since: time.Now().UTC(), done: make(chan struct{})}
+	m.locks[subdomain] = l
+	return &Lease{manager: m, subdomain: subdomain, lock: l}, nil
+}
+
+func (m *LockManager) release(subdomain string, l *tenantLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks[subdomain] == l {
+		delete(m.locks, subdomain)
+	}
+	close(l.done)
+}
+
+// Lease is a held tenant lock. A nil *Lease is valid and releases nothing.
+type Lease struct {
+	manager   *LockManager
+	subdomain string
+	lock      *tenantLock
+	once      sync.Once
+}
+
+// Release gives the lock back. It is safe to call more than once.
+func (l *Lease) Release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() { l.manager.release(l.subdomain, l.lock) })
+}
+
+// leaseKey is the context key under which a held lease is stored
+type leaseKey struct{}
+
+// WithLease returns a context carrying lease, so that operations run with it
+// do not try to take the same tenant lock again
+func WithLease(ctx context.Context, lease *Lease) context.Context {
+	if lease == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, leaseKey{}, lease)
+}
+
+// holdsLease reports whether ctx carries the lease of subdomain
+func holdsLease(ctx context.Context, subdomain string) bool {
+	lease, ok := ctx.Value(leaseKey{}).(*Lease)
+	return ok && lease.subdomain == subdomain
+}
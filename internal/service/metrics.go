@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"log"
+	"slices"
+
+	"github.com/qate/q8-agent/internal/domain"
+	"github.com/qate/q8-agent/internal/metrics"
+)
+
+// Instrument reports in reg, on every scrape, the number of tenants by state
+// and the running and expected containers of every tenant not torn down
+func (s *Orchestrator) Instrument(reg *metrics.Registry) {
+	tenants := reg.Gauge("q8_tenants",
+		"Tenants managed by the agent, by state", "state")
+	running := reg.Gauge("q8_tenant_containers_running",
+		"Running containers of a tenant", "tenant")
+	expected := reg.Gauge("q8_tenant_containers_expected",
+		"Containers a tenant should be running: one per service it has containers for, none while suspended", "tenant")
+
+	reg.OnScrape(func(ctx context.Context) {
+		records, _ := s.registry.List(domain.TenantFilter{})
+
+		counts := map[domain.TenantState]int{
+			domain.TenantActive:    0,
+			domain.TenantFailed:    0,
+			domain.TenantSuspended: 0,
+			domain.TenantTornDown:  0,
+		}
+		running.Reset()
+		expected.Reset()
+		for _, rec := range records {
+			counts[rec.State]++
+			if rec.State == domain.TenantTornDown {
+				continue
+			}
+			s.scrapeContainers(ctx, rec, running, expected)
+		}
+
+		for state, n := range counts {
+			tenants.Set(float64(n), string(state))
+		}
+	})
+}
+
+// scrapeContainers sets the container gauges of a tenant. Expected
+// containers are counted by service from its containers. The gauges are
+// left out when the containers cannot be read.
+func (s *Orchestrator) scrapeContainers(ctx context.Context, rec domain.TenantRecord, running, expected *metrics.Gauge) {
+	containers, err := s.GetTenantStatus(ctx, rec.Subdomain)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Warning: metrics: containers of tenant %s: %s", rec.Subdomain, err)
+		}
+		return
+	}
+
+	n := 0
+	var services []string
+	for _, c := range containers {
+		if c.State == "running" {
+			n++
+		}
+		if !slices.Contains(services, c.Service) {
+			services = append(services, c.Service)
+		}
+	}
+	running.Set(float64(n), rec.Subdomain)
+	if rec.State == domain.TenantSuspended {
+		expected.Set(0, rec.Subdomain)
+	} else {
+		expected.Set(float64(len(services)), rec.Subdomain)
+	}
+}
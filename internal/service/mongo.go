@@ -0,0 +1,270 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// Environment variables through which mongo scripts receive their inputs.
+// Scripts read them with process.env so that user-supplied values are never
+// interpolated into JavaScript source. The tenant names must not collide with
+// the Q8_MONGO_USER and Q8_MONGO_PASSWORD settings of the agent.
+const (
+	envMongoAdminUser     = "Q8_MONGO_ADMIN_USER"
+	envMongoAdminPassword = "Q8_MONGO_ADMIN_PASSWORD"
+	envMongoDatabase      = "Q8_MONGO_TENANT_DB"
+	envMongoUser          = "Q8_MONGO_TENANT_USER"
+	envMongoPassword      = "Q8_MONGO_TENANT_PASSWORD"
+)
+
+// mongoAuthScript authenticates against the admin database with the configured credentials
+const mongoAuthScript = `
+	db = db.getSiblingDB('admin');
+	db.auth(process.env.Q8_MONGO_ADMIN_USER, process.env.Q8_MONGO_ADMIN_PASSWORD);
+`
+
+// mongoCreateUserScript creates a readWrite user on a database, or updates
+// the password when the user already exists and is managed by the agent.
+// Users are marked as managed by the agent through their customData; existing
+// users without the mark are left untouched.
+const mongoCreateUserScript = mongoAuthScript + `
+	db = db.getSiblingDB(process.env.Q8_MONGO_TENANT_DB);
+	const user = db.getUser(process.env.Q8_MONGO_TENANT_USER);
+	let status;
+	if (user === null) {
+		db.createUser({
+			user: process.env.Q8_MONGO_TENANT_USER,
+			pwd: process.env.Q8_MONGO_TENANT_PASSWORD,
+			customData: { managedBy: 'q8-agent' },
+			roles: [{ role: 'readWrite', db: process.env.Q8_MONGO_TENANT_DB }]
+		});
+		status = 'created';
+	} else if (!!user.customData && user.customData.managedBy === 'q8-agent') {
+		db.changeUserPassword(process.env.Q8_MONGO_TENANT_USER, process.env.Q8_MONGO_TENANT_PASSWORD);
+		status = 'updated';
+	} else {
+		status = 'unmanaged';
+	}
+	print('Q8_RESULT ' + JSON.stringify({ status: status }));
+`
+
+// mongoListScript reports the databases holding agent-managed users
+const mongoListScript = mongoAuthScript + `
+	const info = db.adminCommand({ usersInfo: { forAllDBs: true }, filter: { 'customData.managedBy': 'q8-agent' } });
+	const sizes = {};
+	db.adminCommand({ listDatabases: 1 }).databases.forEach(d => { sizes[d.name] = Number(d.sizeOnDisk); });
+	const users = {};
+	info.users.forEach(u => { (users[u.db] = users[u.db] || []).push(u.user); });
+	const result = Object.keys(users).sort().map(name => ({
+		name: name,
+		exists: name in sizes,
+		size_bytes: sizes[name] || 0,
+		users: users[name].sort()
+	}));
+	print('Q8_RESULT ' + JSON.stringify(result));
+`
+
+// mongoRotateScript changes the password of an agent-managed user
+const mongoRotateScript = mongoAuthScript + `
+	db = db.getSiblingDB(process.env.Q8_MONGO_TENANT_DB);
+	const user = db.getUser(process.env.Q8_MONGO_TENANT_USER);
+	const managed = user !== null && !!user.customData && user.customData.managedBy === 'q8-agent';
+	if (managed) {
+		db.changeUserPassword(process.env.Q8_MONGO_TENANT_USER, process.env.Q8_MONGO_TENANT_PASSWORD);
+	}
+	print('Q8_RESULT ' + JSON.stringify({ found: managed }));
+`
+
+// mongoDropScript removes the agent-managed users of a database, then the
+// database itself. Databases without managed users are left alone.
+const mongoDropScript = mongoAuthScript + `
+	db = db.getSiblingDB(process.env.Q8_MONGO_TENANT_DB);
+	const res = db.getUsers({ filter: { 'customData.managedBy': 'q8-agent' } });
+	const users = (Array.isArray(res) ? res : res.users).map(u => u.user);
+	if (users.length > 0) {
+		users.forEach(u => db.dropUser(u));
+		db.dropDatabase();
+	}
+	print('Q8_RESULT ' + JSON.stringify({ found: users.length > 0, dropped_users: users }));
+`
+
+// mongoResultPrefix marks the line on which scripts print their JSON result
+const mongoResultPrefix = "Q8_RESULT "
+
+// generatedPasswordBytes is the entropy of agent-generated passwords
+const generatedPasswordBytes = 24
+
+// ErrMongoNotManaged is returned for databases and users not created by the agent
+var ErrMongoNotManaged = domain.NewError(domain.CodeNotFound, "not managed by the agent")
+
+// CreateMongoDBUser creates a new MongoDB user and database
+func (s *Orchestrator) CreateMongoDBUser(ctx context.Context, req domain.MongoDBUserCreateRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+
+	// Use credentials from config, NOT from request
+	log.Printf("Creating MongoDB user: %s for database: %s using configured mongo host: %s",
+		req.NewUser, req.DatabaseName, s.cfg.MongoHost)
+
+	out, err := s.runMongoScript(ctx, mongoCreateUserScript, map[string]string{
+		envMongoDatabase: req.DatabaseName,
+		envMongoUser:     req.NewUser,
+		envMongoPassword: req.NewPassword,
+	})
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		Status string `json:"status"`
+	}
+	if err := parseMongoResult(out, &result); err != nil {
+		return err
+	}
+	if result.Status == "unmanaged" {
+		return &domain.Error{
+			Code:    domain.CodeConflict,
+			Message: fmt.Sprintf("user %s already exists on database %s and is not managed by the agent", req.NewUser, req.DatabaseName),
+			Details: map[string]string{"database": req.DatabaseName, "user": req.NewUser},
+		}
+	}
+
+	log.Printf("MongoDB user %s on database %s: %s", req.NewUser, req.DatabaseName, result.Status)
+	return nil
+}
+
+// ListMongoDatabases lists the databases holding users managed by the agent
+func (s *Orchestrator) ListMongoDatabases(ctx context.Context) ([]domain.MongoDatabase, error) {
+	out, err := s.runMongoScript(ctx, mongoListScript, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	databases := []domain.MongoDatabase{}
+	if err := parseMongoResult(out, &databases); err != nil {
+		return nil, err
+	}
+	return databases, nil
+}
+
+// RotateMongoPassword sets a new password for an agent-managed user. When
+// password is empty one is generated. The password is not logged.
+func (s *Orchestrator) RotateMongoPassword(ctx context.Context, database, user, password string) (*domain.MongoCredentials, error) {
+	if err := domain.ValidateMongoDatabase("database", database); err != nil {
+		return nil, err
+	}
+	if err := domain.ValidateMongoUser("user", user); err != nil {
+		return nil, err
+	}
+
+	creds := &domain.MongoCredentials{Database: database, User: user, Password: password}
+	if password == "" {
+		generated, err := generatePassword()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate password: %w", err)
+		}
+		creds.Password = generated
+		creds.Generated = true
+	} else if err := domain.ValidateMongoPassword("password", password); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Rotating password of MongoDB user %s on database %s", user, database)
+
+	out, err := s.runMongoScript(ctx, mongoRotateScript, map[string]string{
+		envMongoDatabase: database,
+		envMongoUser:     user,
+		envMongoPassword: creds.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Found bool `json:"found"`
+	}
+	if err := parseMongoResult(out, &result); err != nil {
+		return nil, err
+	}
+	if !result.Found {
+		return nil, fmt.Errorf("user %s on database %s: %w", user, database, ErrMongoNotManaged)
+	}
+	return creds, nil
+}
+
+// DropMongoDatabase removes the agent-managed users of a database and drops it
+func (s *Orchestrator) DropMongoDatabase(ctx context.Context, database string) (*domain.MongoDropResult, error) {
+	if err := domain.ValidateMongoDatabase("database", database); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Dropping MongoDB database %s", database)
+
+	out, err := s.runMongoScript(ctx, mongoDropScript, map[string]string{envMongoDatabase: database})
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Found        bool     `json:"found"`
+		DroppedUsers []string `json:"dropped_users"`
+	}
+	if err := parseMongoResult(out, &result); err != nil {
+		return nil, err
+	}
+	if !result.Found {
+		return nil, fmt.Errorf("database %s: %w", database, ErrMongoNotManaged)
+	}
+
+	log.Printf("MongoDB database %s dropped with users %v", database, result.DroppedUsers)
+	return &domain.MongoDropResult{Database: database, DroppedUsers: result.DroppedUsers}, nil
+}
+
+// runMongoScript executes script against the configured mongo host with the
+// admin credentials and env available through process.env
+func (s *Orchestrator) runMongoScript(ctx context.Context, script string, env map[string]string) ([]byte, error) {
+	vars := map[string]string{
+		envMongoAdminUser:     s.cfg.MongoUser,
+		envMongoAdminPassword: s.cfg.MongoPassword,
+	}
+	for name, value := range env {
+		vars[name] = value
+	}
+
+	// --network host lets the container reach the configured host directly
+	out, err := s.docker.ExecuteMongoScript(ctx, s.cfg.MongoHost, script, vars)
+	if err != nil {
+		return out, composeError(domain.CodeMongoFailed, "mongo execution failed", out, err)
+	}
+	return out, nil
+}
+
+// parseMongoResult decodes the JSON result printed by a script into v
+func parseMongoResult(out []byte, v any) error {
+	for _, line := range strings.Split(string(out), "\n") {
+		if data, ok := strings.CutPrefix(strings.TrimSpace(line), mongoResultPrefix); ok {
+			if err := json.Unmarshal([]byte(data), v); err != nil {
+				return domain.WrapError(domain.CodeMongoFailed, "invalid mongo script result", err)
+			}
+			return nil
+		}
+	}
+	return composeError(domain.CodeMongoFailed, "mongo script printed no result", out, nil)
+}
+
+// generatePassword returns a random URL-safe password
+func generatePassword() (string, error) {
+	b := make([]byte, generatedPasswordBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,48 @@
+package service_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+func TestCreateMongoDBUser(t *testing.T) {
+	tests := []struct {
+		output string
+		code   domain.ErrorCode
+	}{
+		{output: `Q8_RESULT {"status":"created"}`},
+		{output: `Q8_RESULT {"status":"updated"}`},
+		{output: `Q8_RESULT {"status":"unmanaged"}`, code: domain.CodeConflict},
+		{output: "no result", code: domain.CodeMongoFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.backend.SetMongoOutput(tt.output)
+
+			err := e.o.CreateMongoDBUser(context.Background(), domain.MongoDBUserCreateRequest{
+				DatabaseName: "acme",
+				NewUser:      "app",
+				NewPassword:  "s3cret-password",
+			})
+			if tt.code == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if got := domain.CodeOf(err); got != tt.code {
+				t.Fatalf("err = %v, want code %s", err, tt.code)
+			}
+
+			scripts := e.backend.Scripts()
+			if len(scripts) != 1 {
+				t.Fatalf("ran %d scripts, want 1", len(scripts))
+			}
+			if strings.Contains(scripts[0].Script, "s3cret-password") || scripts[0].Env["Q8_MONGO_TENANT_PASSWORD"] != "s3cret-password" {
+				t.Error("the password must reach the script through its environment only")
+			}
+		})
+	}
+}
@@ -1,187 +1,447 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 
 	"github.com/qate/q8-agent/internal/config"
 	"github.com/qate/q8-agent/internal/docker"
 	"github.com/qate/q8-agent/internal/domain"
-	"github.com/qate/q8-agent/internal/fs"
 )
 
 // Orchestrator coordinates tenant operations
 type Orchestrator struct {
-	fs     *fs.Manager
-	docker *docker.Runner
-	cfg    *config.Config
+	fs       WorkspaceStore
+	docker   ComposeBackend
+	registry TenantRegistry
+	secrets  SecretStore
+	locks    *LockManager
+	cfg      *config.Config
 }
 
 // NewOrchestrator creates a new orchestrator
-func NewOrchestrator(cfg *config.Config, fs *fs.Manager, docker *docker.Runner) *Orchestrator {
+func NewOrchestrator(cfg *config.Config, store WorkspaceStore, backend ComposeBackend, registry TenantRegistry, secrets SecretStore) *Orchestrator {
 	return &Orchestrator{
-		fs:     fs,
-		docker: docker,
-		cfg:    cfg,
+		fs:       store,
+		docker:   backend,
+		registry: registry,
+		secrets:  secrets,
+		locks:    NewLockManager(LockMode(cfg.LockMode)),
+		cfg:      cfg,
 	}
 }
 
+// Reserve takes the lock of a tenant ahead of an asynchronous operation so a
+// conflict, or a tenant state that does not allow op, is reported to the
+// caller right away. In queue mode it returns a nil lease and the operation
+// waits for the lock once it runs.
+func (s *Orchestrator) Reserve(subdomain string, op domain.JobType) (*Lease, error) {
+	if s.locks.Mode() == LockQueue {
+		return nil, s.admit(subdomain, op)
+	}
+
+	lease, err := s.locks.Acquire(context.Background(), subdomain, string(op))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.admit(subdomain, op); err != nil {
+		lease.Release()
+		return nil, err
+	}
+	return lease, nil
+}
+
+// lock takes the tenant lock for op unless ctx already holds it
+func (s *Orchestrator) lock(ctx context.Context, subdomain string, op domain.JobType) (func(), error) {
+	if holdsLease(ctx, subdomain) {
+		return func() {}, nil
+	}
+
+	lease, err := s.locks.Acquire(ctx, subdomain, string(op))
+	if err != nil {
+		return nil, err
+	}
+	return lease.Release, nil
+}
+
+// compose runs a compose CLI command with the tenant env content available to
+// docker compose, decrypted only for the duration of the command
+func (s *Orchestrator) compose(subdomain string, run func() ([]byte, error)) ([]byte, error) {
+	cleanup, err := s.fs.MaterializeEnv(subdomain)
+	if err != nil {
+		return nil, fmt.Errorf("env error: %w", err)
+	}
+	defer cleanup()
+	return run()
+}
+
 // ProvisionTenant sets up a new tenant environment
-func (s *Orchestrator) ProvisionTenant(req domain.TenantProvisionRequest) error {
+func (s *Orchestrator) ProvisionTenant(ctx context.Context, req domain.TenantProvisionRequest) (err error) {
+	release, err := s.lock(ctx, req.Subdomain, domain.JobProvision)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := s.admit(req.Subdomain, domain.JobProvision); err != nil {
+		return err
+	}
+	defer func() {
+		s.record(req.Subdomain, domain.JobProvision, err, func(rec *domain.TenantRecord) {
+			rec.ID = req.ID
+			var rbErr *RollbackError
+			switch {
+			case err == nil:
+				rec.State = domain.TenantActive
+				rec.RetainedVolumes = nil // Back in use by the new stack
+			case errors.As(err, &rbErr) && rbErr.Restored && rbErr.RollbackErr == nil:
+				rec.State = domain.TenantActive // Previous configuration is running again
+			default:
+				rec.State = domain.TenantFailed
+			}
+		})
+	}()
+
 	log.Printf("Provisioning tenant: %s (subdomain: %s)", req.ID, req.Subdomain)
 
-	// 1. Prepare directory
+	// 1. Resolve agent-generated secrets
+	env, secrets, err := s.resolveSecrets(ctx, req.Subdomain, req.EnvContent)
+	if err != nil {
+		return err
+	}
+
+	// 2. Prepare directory
+	reportStep(ctx, "preparing directory")
 	dir, err := s.fs.PrepareTenantDir(req.Subdomain)
 	if err != nil {
 		return fmt.Errorf("fs error: %w", err)
 	}
 
-	// 2. Write configs
-	err = s.fs.WriteConfig(req.Subdomain, req.ComposeContent, req.EnvContent)
+	// 3. Keep the previous config aside, then write the new one
+	hadPrevious, err := s.fs.SnapshotConfig(req.Subdomain)
 	if err != nil {
-		return fmt.Errorf("config error: %w", err)
+		return fmt.Errorf("snapshot error: %w", err)
 	}
 
-	// 3. Pull and Up
 	project := fmt.Sprintf("q8-%s", req.Subdomain)
 
+	reportStep(ctx, "writing config")
+	err = s.fs.WriteConfig(req.Subdomain, req.ComposeContent, env)
+	if err != nil {
+		return s.rollbackProvision(ctx, req.Subdomain, project, dir, hadPrevious, stageConfig, fmt.Errorf("config error: %w", err))
+	}
+
+	// 4. Pull and Up
 	log.Printf("Pulling images for project: %s", project)
-	if out, err := s.docker.ExecuteComposePull(project, dir); err != nil {
-		return fmt.Errorf("docker pull error: %s: %w", string(out), err)
+	reportStep(ctx, "pulling images")
+	out, err := s.compose(req.Subdomain, func() ([]byte, error) { return s.docker.ExecuteComposePull(ctx, project, dir) })
+	reportOutput(ctx, out)
+	if err != nil {
+		return s.rollbackProvision(ctx, req.Subdomain, project, dir, hadPrevious, stagePull, composeError(domain.CodeImagePullFailed, "docker pull error", out, err))
 	}
 
 	log.Printf("Spinning up containers for project: %s", project)
-	if out, err := s.docker.ExecuteComposeUp(project, dir); err != nil {
-		return fmt.Errorf("docker up error: %s: %w", string(out), err)
+	reportStep(ctx, "starting containers")
+	out, err = s.compose(req.Subdomain, func() ([]byte, error) { return s.docker.ExecuteComposeUp(ctx, project, dir) })
+	reportOutput(ctx, out)
+	if err != nil {
+		return s.rollbackProvision(ctx, req.Subdomain, project, dir, hadPrevious, stageUp, composeError(domain.CodeComposeFailed, "docker up error", out, err))
 	}
 
+	s.discardSnapshot(req.Subdomain)
+	s.reportSecrets(ctx, req.Subdomain, secrets)
+
 	log.Printf("Tenant %s provisioned successfully", req.ID)
 	return nil
 }
 
-// TeardownTenant removes a tenant environment
-func (s *Orchestrator) TeardownTenant(subdomain string) error {
-	log.Printf("Tearing down tenant: %s", subdomain)
+// TeardownTenant removes a tenant environment. The config is archived unless
+// purging; mode decides whether the volumes are kept, backed up into the
+// archive then removed, or removed. Purging also forgets the tenant secrets.
+func (s *Orchestrator) TeardownTenant(ctx context.Context, subdomain string, mode domain.TeardownMode) (result *domain.TenantTeardownResult, err error) {
+	release, err := s.lock(ctx, subdomain, domain.JobTeardown)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := s.admit(subdomain, domain.JobTeardown); err != nil {
+		return nil, err
+	}
+	defer func() {
+		s.record(subdomain, domain.JobTeardown, err, func(rec *domain.TenantRecord) {
+			if err == nil {
+				rec.State = domain.TenantTornDown
+				rec.SuspendedAt = nil
+				rec.SuspendedContainers = nil
+				rec.Archive = result.Archive
+				rec.RetainedVolumes = result.RetainedVolumes
+			}
+		})
+	}()
+
+	log.Printf("Tearing down tenant: %s (mode: %s)", subdomain, mode)
 
 	project := fmt.Sprintf("q8-%s", subdomain)
-	dir := s.fs.GetTenantPath(subdomain)
+	dir, err := s.fs.GetTenantPath(subdomain)
+	if err != nil {
+		return nil, err
+	}
 
-	// 1. Docker down
-	if out, err := s.docker.ExecuteComposeDown(project, dir); err != nil {
-		log.Printf("Warning: docker down failed (might already be gone): %s", string(out))
+	// 1. Docker down, keeping volumes
+	reportStep(ctx, "stopping containers")
+	out, err := s.compose(subdomain, func() ([]byte, error) { return s.docker.ExecuteComposeDown(ctx, project, dir) })
+	reportOutput(ctx, out)
+	if err != nil {
+		// Removing volumes or files under running containers is not safe
+		containers, psErr := s.docker.ComposePs(ctx, project)
+		if psErr != nil || len(containers) > 0 {
+			return nil, composeError(domain.CodeComposeFailed, "docker down error", out, err)
+		}
+		log.Printf("Warning: docker down failed, no containers left: %s", string(out))
 	}
 
-	// 2. Archive files instead of removing
-	newDir, err := s.fs.ArchiveTenantDir(subdomain)
+	volumes, err := s.docker.ComposeVolumes(ctx, project)
 	if err != nil {
-		return fmt.Errorf("fs archive error: %w", err)
+		return nil, engineError("docker volumes error", err)
+	}
+	result = &domain.TenantTeardownResult{Mode: mode}
+
+	// 2. Back up the volumes next to the config so they are archived with it
+	if mode == domain.TeardownBackup {
+		for _, v := range volumes {
+			reportStep(ctx, fmt.Sprintf("backing up volume %s", v))
+			if err := s.backupVolume(ctx, subdomain, v); err != nil {
+				return nil, err
+			}
+			result.BackedUp = append(result.BackedUp, v)
+		}
 	}
 
+	// 3. Remove the volumes unless they are kept
+	if mode == domain.TeardownKeepVolumes {
+		result.RetainedVolumes = volumes
+	} else {
+		for _, v := range volumes {
+			reportStep(ctx, fmt.Sprintf("removing volume %s", v))
+			if err := s.docker.RemoveVolume(ctx, v); err != nil {
+				return nil, engineError(fmt.Sprintf("failed to remove volume %s", v), err)
+			}
+			result.RemovedVolumes = append(result.RemovedVolumes, v)
+		}
+	}
+
+	// 4. Archive files instead of removing, unless purging
+	if mode == domain.TeardownPurge {
+		reportStep(ctx, "removing directory")
+		if err := s.fs.RemoveTenantDir(subdomain); err != nil {
+			return nil, fmt.Errorf("fs remove error: %w", err)
+		}
+		if err := s.secrets.Delete(subdomain); err != nil {
+			return nil, fmt.Errorf("secret store error: %w", err)
+		}
+		log.Printf("Tenant %s purged", subdomain)
+		reportResult(ctx, result)
+		return result, nil
+	}
+
+	reportStep(ctx, "archiving directory")
+	newDir, err := s.fs.ArchiveTenantDir(subdomain, result.RetainedVolumes)
+	if err != nil {
+		return nil, fmt.Errorf("fs archive error: %w", err)
+	}
+	result.Archive = newDir
+
 	if newDir != "" {
 		log.Printf("Tenant %s archived to %s", subdomain, newDir)
 	} else {
 		log.Printf("Tenant %s directory not found, nothing to archive", subdomain)
 	}
+	if len(result.RetainedVolumes) > 0 {
+		log.Printf("Tenant %s volumes retained: %v", subdomain, result.RetainedVolumes)
+	}
 
+	reportResult(ctx, result)
+	return result, nil
+}
+
+// backupVolume archives the contents of a volume into the tenant directory
+func (s *Orchestrator) backupVolume(ctx context.Context, subdomain, volume string) error {
+	w, err := s.fs.CreateVolumeBackup(subdomain, volume)
+	if err != nil {
+		return fmt.Errorf("fs backup error: %w", err)
+	}
+	err = s.docker.BackupVolume(ctx, volume, w)
+	if closeErr := w.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("fs backup error: %w", closeErr)
+	}
+	if err != nil {
+		return domain.WrapError(domain.CodeDockerError, "volume backup error", err)
+	}
 	return nil
 }
 
 // RestartTenant restarts a tenant's containers
-func (s *Orchestrator) RestartTenant(subdomain string) error {
+func (s *Orchestrator) RestartTenant(ctx context.Context, subdomain string) (err error) {
+	release, err := s.lock(ctx, subdomain, domain.JobRestart)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := s.admit(subdomain, domain.JobRestart); err != nil {
+		return err
+	}
+	defer func() { s.record(subdomain, domain.JobRestart, err, nil) }()
+
 	log.Printf("Restarting tenant: %s", subdomain)
 
 	project := fmt.Sprintf("q8-%s", subdomain)
-	dir := s.fs.GetTenantPath(subdomain)
 
-	if out, err := s.docker.ExecuteComposeRestart(project, dir); err != nil {
-		return fmt.Errorf("docker restart error: %s: %w", string(out), err)
+	reportStep(ctx, "restarting containers")
+	if err := s.docker.ComposeRestart(ctx, project); err != nil {
+		return engineError("docker restart error", err)
 	}
 
 	return nil
 }
 
-// GetTenantStatus returns the status of a tenant's containers
-func (s *Orchestrator) GetTenantStatus(subdomain string) (string, error) {
-	project := fmt.Sprintf("q8-%s", subdomain)
-	dir := s.fs.GetTenantPath(subdomain)
+// UpdateTenant pulls the images of a tenant and recreates only the services
+// whose image changed, leaving the config files untouched
+func (s *Orchestrator) UpdateTenant(ctx context.Context, req domain.TenantUpdateRequest) (result *domain.TenantUpdateResult, err error) {
+	release, err := s.lock(ctx, req.Subdomain, domain.JobUpdate)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := s.admit(req.Subdomain, domain.JobUpdate); err != nil {
+		return nil, err
+	}
+	defer func() { s.record(req.Subdomain, domain.JobUpdate, err, nil) }()
 
-	out, err := s.docker.ExecuteComposePs(project, dir)
+	log.Printf("Updating tenant: %s", req.Subdomain)
+
+	project := fmt.Sprintf("q8-%s", req.Subdomain)
+	dir, err := s.fs.GetTenantPath(req.Subdomain)
 	if err != nil {
-		return "", fmt.Errorf("docker ps error: %s: %w", string(out), err)
+		return nil, err
 	}
 
-	return string(out), nil
-}
+	// 1. Record the images currently running, one per service
+	reportStep(ctx, "inspecting images")
+	images, err := s.docker.ComposeImages(ctx, project)
+	if err != nil {
+		return nil, engineError("docker images error", err)
+	}
+	if len(images) == 0 {
+		return nil, ErrTenantNotFound
+	}
 
-// GetTenantLogs returns the logs of a tenant's containers
-func (s *Orchestrator) GetTenantLogs(subdomain string, tail int) (string, error) {
-	project := fmt.Sprintf("q8-%s", subdomain)
-	dir := s.fs.GetTenantPath(subdomain)
+	current := make(map[string]docker.ServiceImage)
+	var services []string
+	for _, img := range images {
+		if _, seen := current[img.Service]; !seen {
+			current[img.Service] = img
+			services = append(services, img.Service)
+		}
+	}
+	if len(req.Services) > 0 {
+		for _, svc := range req.Services {
+			if _, ok := current[svc]; !ok {
+				return nil, &domain.ValidationError{Field: "services", Value: svc, Reason: "is not a running service of this tenant"}
+			}
+		}
+		services = req.Services
+	}
 
-	out, err := s.docker.ExecuteComposeLogs(project, dir, tail)
+	// 2. Pull
+	reportStep(ctx, "pulling images")
+	out, err := s.compose(req.Subdomain, func() ([]byte, error) { return s.docker.ExecuteComposePull(ctx, project, dir) })
+	reportOutput(ctx, out)
 	if err != nil {
-		return "", fmt.Errorf("docker logs error: %s: %w", string(out), err)
+		return nil, composeError(domain.CodeImagePullFailed, "docker pull error", out, err)
+	}
+
+	// 3. Compare digests
+	result = &domain.TenantUpdateResult{Updated: []domain.ServiceUpdate{}, Unchanged: []string{}}
+	var changed []string
+	for _, svc := range services {
+		img := current[svc]
+		newID, err := s.docker.ImageID(ctx, img.Image)
+		if err != nil {
+			return nil, engineError(fmt.Sprintf("failed to resolve image %s of %s", img.Image, svc), err)
+		}
+		if newID == img.ImageID {
+			result.Unchanged = append(result.Unchanged, svc)
+			continue
+		}
+		changed = append(changed, svc)
+		result.Updated = append(result.Updated, domain.ServiceUpdate{
+			Service:    svc,
+			Image:      img.Image,
+			OldImageID: img.ImageID,
+			NewImageID: newID,
+		})
 	}
 
-	return string(out), nil
+	// 4. Recreate changed services only
+	if len(changed) > 0 {
+		log.Printf("Recreating services %v of project: %s", changed, project)
+		reportStep(ctx, "recreating changed services")
+		out, err = s.compose(req.Subdomain, func() ([]byte, error) { return s.docker.ExecuteComposeUpServices(ctx, project, dir, changed) })
+		reportOutput(ctx, out)
+		if err != nil {
+			return nil, composeError(domain.CodeComposeFailed, "docker up error", out, err)
+		}
+	}
+
+	reportResult(ctx, result)
+	log.Printf("Tenant %s updated: %d service(s) recreated", req.Subdomain, len(changed))
+	return result, nil
 }
 
-// GetTenantImages returns the images of a tenant's containers
-func (s *Orchestrator) GetTenantImages(subdomain string) (string, error) {
+// GetTenantStatus returns the status of a tenant's containers
+func (s *Orchestrator) GetTenantStatus(ctx context.Context, subdomain string) ([]docker.ServiceContainer, error) {
 	project := fmt.Sprintf("q8-%s", subdomain)
-	dir := s.fs.GetTenantPath(subdomain)
 
-	out, err := s.docker.ExecuteComposeImages(project, dir)
+	containers, err := s.docker.ComposePs(ctx, project)
 	if err != nil {
-		return "", fmt.Errorf("docker images error: %s: %w", string(out), err)
+		return nil, engineError("docker ps error", err)
 	}
 
-	return string(out), nil
+	return containers, nil
 }
 
-// CreateMongoDBUser creates a new MongoDB user and database
-func (s *Orchestrator) CreateMongoDBUser(req domain.MongoDBUserCreateRequest) error {
-	// Use credentials from config, NOT from request
-	log.Printf("Creating MongoDB user: %s for database: %s using configured mongo host: %s",
-		req.NewUser, req.DatabaseName, s.cfg.MongoHost)
-
-	// Format connection string for admin using configured credentials
-	// connString := fmt.Sprintf("mongodb://%s:%s@%s:%s/admin",
-	// 	s.cfg.MongoUser, s.cfg.MongoPassword, s.cfg.MongoHost, s.cfg.MongoPort)
-
-	// Construct script
-	// Note: We still use req.NewUser and req.NewPassword from request as these are specific to the new tenant
-	script := fmt.Sprintf(`
-		db = db.getSiblingDB('admin');
-		db.auth('%s', '%s');
-		db = db.getSiblingDB('%s');
-		try {
-			db.createUser({
-				user: '%s',
-				pwd: '%s',
-				roles: [{ role: 'readWrite', db: '%s' }]
-			});
-			print('User created successfully');
-		} catch (e) {
-			if (e.code === 51003) { // User already exists
-				db.changeUserPassword('%s', '%s');
-				print('User already exists, password updated');
-			} else {
-				throw e;
-			}
+// TenantLogs writes the logs of a tenant's containers to dst. Service filters
+// must name services the tenant has containers for. When following, it
+// returns once ctx is done.
+func (s *Orchestrator) TenantLogs(ctx context.Context, subdomain string, opts docker.ComposeLogsOptions, dst io.Writer) error {
+	project := fmt.Sprintf("q8-%s", subdomain)
+
+	if len(opts.Services) > 0 {
+		if err := s.CheckServices(ctx, subdomain, opts.Services); err != nil {
+			return err
 		}
-	`, s.cfg.MongoUser, s.cfg.MongoPassword, req.DatabaseName,
-		req.NewUser, req.NewPassword, req.DatabaseName,
-		req.NewUser, req.NewPassword)
+	}
 
-	// Execute via docker using the configured host IP
-	// For 'host' logic in docker run, we might need special handling if MongoHost is not reachable
-	// from within the container easily unless we use --network host which we do.
-	out, err := s.docker.ExecuteMongoScript(s.cfg.MongoHost, script)
+	if err := s.docker.ComposeLogs(ctx, project, opts, dst); err != nil {
+		return engineError("docker logs error", err)
+	}
+	return nil
+}
+
+// GetTenantImages returns the images of a tenant's containers
+func (s *Orchestrator) GetTenantImages(ctx context.Context, subdomain string) ([]docker.ServiceImage, error) {
+	project := fmt.Sprintf("q8-%s", subdomain)
+
+	images, err := s.docker.ComposeImages(ctx, project)
 	if err != nil {
-		return fmt.Errorf("mongo execution failed: %s: %w", string(out), err)
+		return nil, engineError("docker images error", err)
 	}
 
-	log.Printf("MongoDB user creation output: %s", string(out))
-	return nil
+	return images, nil
 }
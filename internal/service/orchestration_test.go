@@ -0,0 +1,438 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/qate/q8-agent/internal/config"
+	"github.com/qate/q8-agent/internal/docker/dockertest"
+	"github.com/qate/q8-agent/internal/domain"
+	"github.com/qate/q8-agent/internal/fs"
+	"github.com/qate/q8-agent/internal/service"
+	"github.com/qate/q8-agent/internal/state"
+)
+
+const testCompose = "services:\n  web:\n    image: nginx\n  worker:\n    image: worker\n"
+
+var errBoom = errors.New("boom")
+
+// testEnv is an orchestrator running on the in-memory compose backend
+type testEnv struct {
+	root     string
+	o        *service.Orchestrator
+	backend  *dockertest.Backend
+	registry *state.Store
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	root := t.TempDir()
+	cfg := &config.Config{TenantsRoot: root, StateDir: filepath.Join(root, ".q8-agent"), LockMode: string(service.LockReject)}
+	registry, err := state.Open(filepath.Join(cfg.StateDir, "tenants.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := state.OpenSecrets(filepath.Join(cfg.StateDir, "secrets.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := dockertest.NewBackend()
+	o := service.NewOrchestrator(cfg, fs.NewManager(root, nil), backend, registry, secrets)
+	return &testEnv{root: root, o: o, backend: backend, registry: registry}
+}
+
+func (e *testEnv) provision(t *testing.T, subdomain, compose string) error {
+	t.Helper()
+	e.backend.SetServices("q8-"+subdomain, "web", "worker")
+	return e.o.ProvisionTenant(context.Background(), domain.TenantProvisionRequest{
+		ID:             "id-" + subdomain,
+		Subdomain:      subdomain,
+		ComposeContent: compose,
+		EnvContent:     "A=1\n",
+	})
+}
+
+func (e *testEnv) state(t *testing.T, subdomain string) domain.TenantState {
+	t.Helper()
+	rec, ok := e.registry.Get(subdomain)
+	if !ok {
+		t.Fatalf("tenant %s is not in the registry", subdomain)
+	}
+	return rec.State
+}
+
+func (e *testEnv) called(method, project string) bool {
+	return slices.ContainsFunc(e.backend.Calls(), func(c dockertest.Call) bool {
+		return c.Method == method && c.Project == project
+	})
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestProvisionTenant(t *testing.T) {
+	e := newTestEnv(t)
+
+	if err := e.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+
+	p, ok := e.backend.Project("q8-acme")
+	if !ok || !p.Running {
+		t.Fatal("project q8-acme is not running")
+	}
+	if p.Dir != filepath.Join(e.root, "acme") {
+		t.Errorf("project dir = %s, want %s", p.Dir, filepath.Join(e.root, "acme"))
+	}
+	if got := readFile(t, filepath.Join(e.root, "acme", "docker-compose.yml")); got != testCompose {
+		t.Errorf("docker-compose.yml = %q", got)
+	}
+	if !e.called("ExecuteComposePull", "q8-acme") {
+		t.Error("images were not pulled")
+	}
+	if got := e.state(t, "acme"); got != domain.TenantActive {
+		t.Errorf("state = %s, want %s", got, domain.TenantActive)
+	}
+
+	containers, err := e.o.GetTenantStatus(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 2 || containers[0].Service != "web" || containers[1].State != "running" {
+		t.Errorf("containers = %+v", containers)
+	}
+}
+
+func TestProvisionTenantFailureRemovesNewStack(t *testing.T) {
+	tests := []struct {
+		method string
+		code   domain.ErrorCode
+		// down is whether containers were started and must be removed
+		down bool
+	}{
+		{"ExecuteComposePull", domain.CodeImagePullFailed, false},
+		{"ExecuteComposeUp", domain.CodeComposeFailed, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.backend.FailOn(tt.method, errBoom)
+
+			err := e.provision(t, "acme", testCompose)
+			var rbErr *service.RollbackError
+			if !errors.As(err, &rbErr) {
+				t.Fatalf("err = %v, want a RollbackError", err)
+			}
+			if rbErr.Restored || rbErr.RollbackErr != nil {
+				t.Errorf("rollback = %+v, want the new stack removed", rbErr)
+			}
+			if got := domain.CodeOf(err); got != tt.code {
+				t.Errorf("code = %s, want %s", got, tt.code)
+			}
+			if !errors.Is(err, errBoom) {
+				t.Errorf("err = %v, want it to wrap the backend error", err)
+			}
+			if down := e.called("ExecuteComposeDown", "q8-acme"); down != tt.down {
+				t.Errorf("stack brought down = %t, want %t", down, tt.down)
+			}
+			if _, ok := e.backend.Project("q8-acme"); ok {
+				t.Error("project q8-acme still exists")
+			}
+			if got := e.state(t, "acme"); got != domain.TenantFailed {
+				t.Errorf("state = %s, want %s", got, domain.TenantFailed)
+			}
+		})
+	}
+}
+
+func TestProvisionTenantFailureRestoresPrevious(t *testing.T) {
+	e := newTestEnv(t)
+	if err := e.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+
+	e.backend.FailOn("ExecuteComposeUp", errBoom)
+	err := e.provision(t, "acme", "services:\n  web:\n    image: nginx:broken\n")
+
+	var rbErr *service.RollbackError
+	if !errors.As(err, &rbErr) {
+		t.Fatalf("err = %v, want a RollbackError", err)
+	}
+	if !rbErr.Restored || rbErr.RollbackErr != nil {
+		t.Errorf("rollback = %+v, want the previous configuration restored", rbErr)
+	}
+	if got := readFile(t, filepath.Join(e.root, "acme", "docker-compose.yml")); got != testCompose {
+		t.Errorf("docker-compose.yml = %q, want the previous content", got)
+	}
+	if !e.called("ExecuteComposeUpCached", "q8-acme") {
+		t.Error("the previous stack was not brought back")
+	}
+	if got := e.state(t, "acme"); got != domain.TenantActive {
+		t.Errorf("state = %s, want %s", got, domain.TenantActive)
+	}
+}
+
+func TestProvisionTenantPullFailureKeepsPrevious(t *testing.T) {
+	e := newTestEnv(t)
+	if err := e.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+
+	e.backend.FailOn("ExecuteComposePull", errBoom)
+	err := e.provision(t, "acme", "services:\n  web:\n    image: nginx:missing\n")
+
+	var rbErr *service.RollbackError
+	if !errors.As(err, &rbErr) || !rbErr.Restored || rbErr.RollbackErr != nil {
+		t.Fatalf("err = %v, want the previous configuration restored", err)
+	}
+	if got := readFile(t, filepath.Join(e.root, "acme", "docker-compose.yml")); got != testCompose {
+		t.Errorf("docker-compose.yml = %q, want the previous content", got)
+	}
+	if e.called("ExecuteComposeUpCached", "q8-acme") {
+		t.Error("the untouched stack was recreated")
+	}
+	if p, _ := e.backend.Project("q8-acme"); !p.Running {
+		t.Error("the previous stack is not running")
+	}
+}
+
+func TestProvisionTenantConfigFailureRemovesFiles(t *testing.T) {
+	e := newTestEnv(t)
+	// A directory in place of .env makes writing the config fail halfway
+	if err := os.MkdirAll(filepath.Join(e.root, "acme", ".env"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := e.provision(t, "acme", testCompose)
+	var rbErr *service.RollbackError
+	if !errors.As(err, &rbErr) || rbErr.RollbackErr != nil {
+		t.Fatalf("err = %v, want a successful rollback", err)
+	}
+	if _, err := os.Stat(filepath.Join(e.root, "acme", "docker-compose.yml")); !os.IsNotExist(err) {
+		t.Errorf("docker-compose.yml left behind: %v", err)
+	}
+	if calls := e.backend.Calls(); len(calls) != 0 {
+		t.Errorf("compose called: %+v", calls)
+	}
+}
+
+func TestProvisionTenantRollbackFailure(t *testing.T) {
+	e := newTestEnv(t)
+	if err := e.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+
+	e.backend.FailOn("ExecuteComposeUp", errBoom)
+	e.backend.FailOn("ExecuteComposeUpCached", errBoom)
+	err := e.provision(t, "acme", testCompose)
+
+	var rbErr *service.RollbackError
+	if !errors.As(err, &rbErr) || rbErr.RollbackErr == nil {
+		t.Fatalf("err = %v, want a failed rollback", err)
+	}
+	if got := e.state(t, "acme"); got != domain.TenantFailed {
+		t.Errorf("state = %s, want %s", got, domain.TenantFailed)
+	}
+}
+
+func TestTeardownTenant(t *testing.T) {
+	volumes := []string{"q8-acme_data", "q8-acme_db"}
+	tests := []struct {
+		mode     domain.TeardownMode
+		retained []string
+		removed  []string
+		backedUp []string
+		archived bool
+	}{
+		{mode: domain.TeardownKeepVolumes, retained: volumes, archived: true},
+		{mode: domain.TeardownBackup, removed: volumes, backedUp: volumes, archived: true},
+		{mode: domain.TeardownPurge, removed: volumes},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			e := newTestEnv(t)
+			if err := e.provision(t, "acme", testCompose); err != nil {
+				t.Fatal(err)
+			}
+			e.backend.SetVolumes("q8-acme", volumes...)
+
+			result, err := e.o.TeardownTenant(context.Background(), "acme", tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(result.RetainedVolumes, tt.retained) || !slices.Equal(result.RemovedVolumes, tt.removed) || !slices.Equal(result.BackedUp, tt.backedUp) {
+				t.Errorf("result = %+v", result)
+			}
+			if _, ok := e.backend.Project("q8-acme"); ok {
+				t.Error("project q8-acme still exists")
+			}
+			if _, err := os.Stat(filepath.Join(e.root, "acme")); !os.IsNotExist(err) {
+				t.Errorf("tenant directory still exists: %v", err)
+			}
+			if archived := result.Archive != ""; archived != tt.archived {
+				t.Errorf("archive = %q, want archived %t", result.Archive, tt.archived)
+			}
+			for _, v := range tt.backedUp {
+				if _, err := os.Stat(filepath.Join(e.root, result.Archive, "volumes", v+".tar.gz")); err != nil {
+					t.Errorf("backup of %s: %v", v, err)
+				}
+			}
+			if got := e.state(t, "acme"); got != domain.TenantTornDown {
+				t.Errorf("state = %s, want %s", got, domain.TenantTornDown)
+			}
+		})
+	}
+}
+
+func TestTeardownTenantVolumeFailure(t *testing.T) {
+	e := newTestEnv(t)
+	if err := e.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+	e.backend.SetVolumes("q8-acme", "q8-acme_data")
+	e.backend.FailOn("RemoveVolume", errBoom)
+
+	_, err := e.o.TeardownTenant(context.Background(), "acme", domain.TeardownPurge)
+	if got := domain.CodeOf(err); got != domain.CodeDockerError {
+		t.Fatalf("err = %v, want code %s", err, domain.CodeDockerError)
+	}
+	if _, statErr := os.Stat(filepath.Join(e.root, "acme")); statErr != nil {
+		t.Errorf("tenant directory removed despite the failure: %v", statErr)
+	}
+	if got := e.state(t, "acme"); got == domain.TenantTornDown {
+		t.Errorf("state = %s after a failed teardown", got)
+	}
+}
+
+func TestTeardownTenantDownFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers bool
+		code       domain.ErrorCode
+	}{
+		{name: "containers left", containers: true, code: domain.CodeComposeFailed},
+		{name: "no containers left"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			ctx := context.Background()
+			if err := e.provision(t, "acme", testCompose); err != nil {
+				t.Fatal(err)
+			}
+			e.backend.SetVolumes("q8-acme", "q8-acme_data")
+			if !tt.containers {
+				if _, err := e.backend.ExecuteComposeDown(ctx, "q8-acme", ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			e.backend.FailOn("ExecuteComposeDown", errBoom)
+
+			_, err := e.o.TeardownTenant(ctx, "acme", domain.TeardownPurge)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("TeardownTenant: %v", err)
+				}
+				return
+			}
+			if got := domain.CodeOf(err); got != tt.code {
+				t.Fatalf("err = %v, want code %s", err, tt.code)
+			}
+			if e.called("RemoveVolume", "q8-acme_data") {
+				t.Error("volume removed under running containers")
+			}
+			if _, statErr := os.Stat(filepath.Join(e.root, "acme")); statErr != nil {
+				t.Errorf("tenant directory removed despite the failure: %v", statErr)
+			}
+		})
+	}
+}
+
+func TestTeardownTenantTornDown(t *testing.T) {
+	e := newTestEnv(t)
+	if err := e.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.o.TeardownTenant(context.Background(), "acme", domain.TeardownPurge); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := e.o.TeardownTenant(context.Background(), "acme", domain.TeardownPurge)
+	if got := domain.CodeOf(err); got != domain.CodeTenantNotFound {
+		t.Errorf("err = %v, want code %s", err, domain.CodeTenantNotFound)
+	}
+}
+
+func TestTeardownTenantPurgeForgetsSecrets(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	provision := func() string {
+		t.Helper()
+		e.backend.SetServices("q8-acme", "web")
+		err := e.o.ProvisionTenant(ctx, domain.TenantProvisionRequest{
+			ID:             "id-acme",
+			Subdomain:      "acme",
+			ComposeContent: testCompose,
+			EnvContent:     "DB_PASSWORD=${q8:secret:DB_PASSWORD}\n",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readFile(t, filepath.Join(e.root, "acme", ".env"))
+	}
+
+	first := provision()
+	if _, err := e.o.TeardownTenant(ctx, "acme", domain.TeardownPurge); err != nil {
+		t.Fatal(err)
+	}
+	if second := provision(); second == first {
+		t.Errorf("re-provision after a purge reused the secret: %q", second)
+	}
+}
+
+func TestRestartTenant(t *testing.T) {
+	e := newTestEnv(t)
+	if err := e.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.o.RestartTenant(context.Background(), "acme"); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := e.backend.Project("q8-acme")
+	if p.Restarts != 1 {
+		t.Errorf("restarts = %d, want 1", p.Restarts)
+	}
+
+	e.backend.FailOn("ComposeRestart", errBoom)
+	err := e.o.RestartTenant(context.Background(), "acme")
+	if got := domain.CodeOf(err); got != domain.CodeDockerError {
+		t.Errorf("err = %v, want code %s", err, domain.CodeDockerError)
+	}
+	rec, _ := e.registry.Get("acme")
+	if rec.LastOperation != domain.JobRestart || rec.LastResult != domain.JobFailed {
+		t.Errorf("last operation = %s %s, want a failed restart", rec.LastOperation, rec.LastResult)
+	}
+}
+
+func TestGetTenantStatusFailure(t *testing.T) {
+	e := newTestEnv(t)
+	e.backend.FailOn("ComposePs", errBoom)
+
+	_, err := e.o.GetTenantStatus(context.Background(), "acme")
+	if got := domain.CodeOf(err); got != domain.CodeDockerError {
+		t.Errorf("err = %v, want code %s", err, domain.CodeDockerError)
+	}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// RollbackError is returned when a provision failed after the tenant config
+// was overwritten. It carries the outcome of the rollback that followed.
+type RollbackError struct {
+	Err         error // The provision failure
+	RollbackErr error // Nil when the rollback succeeded
+	Restored    bool  // Whether a previous configuration was brought back
+}
+
+func (e *RollbackError) Error() string {
+	switch {
+	case e.RollbackErr != nil:
+		return fmt.Sprintf("%s; rollback failed: %s", e.Err, e.RollbackErr)
+	case e.Restored:
+		return fmt.Sprintf("%s; rolled back to previous configuration", e.Err)
+	default:
+		return fmt.Sprintf("%s; rolled back, containers removed", e.Err)
+	}
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// provisionStage is the step of a provision that failed
+type provisionStage int
+
+const (
+	// stageConfig is writing the config files
+	stageConfig provisionStage = iota
+	// stagePull is pulling the images, the running stack is untouched
+	stagePull
+	// stageUp is recreating the containers
+	stageUp
+)
+
+// rollbackProvision undoes a provision that failed at stage. With a previous
+// configuration it restores the config files and, when the containers were
+// recreated, brings the previous stack back up without pulling. Otherwise it
+// removes whatever the failed attempt left: the stack it started, or the
+// config files it did not finish writing.
+func (s *Orchestrator) rollbackProvision(ctx context.Context, subdomain, project, dir string, hadPrevious bool, stage provisionStage, cause error) error {
+	// Roll back even when the job was cancelled, the tenant must not stay half-updated
+	ctx = context.WithoutCancel(ctx)
+
+	reportStep(ctx, "rolling back")
+	log.Printf("Rolling back tenant %s: %s", subdomain, cause)
+
+	rbErr := &RollbackError{Err: cause, Restored: hadPrevious}
+	if !hadPrevious {
+		switch stage {
+		case stageConfig:
+			if err := s.fs.RemoveConfig(subdomain); err != nil {
+				rbErr.RollbackErr = fmt.Errorf("config remove error: %w", err)
+			}
+			return rbErr
+		case stagePull:
+			return rbErr // Nothing was started
+		}
+
+		out, err := s.compose(subdomain, func() ([]byte, error) { return s.docker.ExecuteComposeDown(ctx, project, dir) })
+		reportOutput(ctx, out)
+		if err != nil {
+			rbErr.RollbackErr = composeError(domain.CodeComposeFailed, "docker down error", out, err)
+		}
+		return rbErr
+	}
+
+	if err := s.fs.RestoreConfig(subdomain); err != nil {
+		rbErr.RollbackErr = fmt.Errorf("config restore error: %w", err)
+		return rbErr
+	}
+	if stage < stageUp {
+		// The previous stack is still running on the restored config
+		s.discardSnapshot(subdomain)
+		return rbErr
+	}
+	out, err := s.compose(subdomain, func() ([]byte, error) { return s.docker.ExecuteComposeUpCached(ctx, project, dir) })
+	reportOutput(ctx, out)
+	if err != nil {
+		rbErr.RollbackErr = composeError(domain.CodeComposeFailed, "docker up error", out, err)
+		return rbErr
+	}
+
+	s.discardSnapshot(subdomain)
+	return rbErr
+}
+
+func (s *Orchestrator) discardSnapshot(subdomain string) {
+	if err := s.fs.DiscardSnapshot(subdomain); err != nil {
+		log.Printf("Warning: failed to discard config snapshot of %s: %s", subdomain, err)
+	}
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// resolveSecrets replaces the ${q8:secret:NAME} placeholders of env with the
+// tenant's stored secrets, generating missing ones. It also returns the
+// pending secrets, which reportSecrets hands out once the provision succeeds.
+func (s *Orchestrator) resolveSecrets(ctx context.Context, subdomain, env string) (string, map[string]string, error) {
+	names, err := domain.SecretPlaceholders(env)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(names) == 0 {
+		return env, nil, nil
+	}
+
+	reportStep(ctx, "resolving secrets")
+	values, pending, err := s.secrets.Ensure(subdomain, names)
+	if err != nil {
+		return "", nil, fmt.Errorf("secret store error: %w", err)
+	}
+
+	var secrets map[string]string
+	if len(pending) > 0 {
+		log.Printf("Pending secrets for tenant %s: %v", subdomain, pending)
+		secrets = make(map[string]string, len(pending))
+		for _, name := range pending {
+			secrets[name] = values[name]
+		}
+	}
+	return domain.ExpandSecrets(env, values), secrets, nil
+}
+
+// reportSecrets reports the pending secrets of a successful provision as the
+// job result, the only place they are ever returned, and stops them from
+// being reported again. Without a job they are kept pending.
+func (s *Orchestrator) reportSecrets(ctx context.Context, subdomain string, secrets map[string]string) {
+	if len(secrets) == 0 || !reportSecretResult(ctx, domain.TenantProvisionResult{Secrets: secrets}) {
+		return
+	}
+
+	names := slices.Collect(maps.Keys(secrets))
+	sort.Strings(names)
+	if err := s.secrets.Confirm(subdomain, names); err != nil {
+		log.Printf("Warning: secrets of tenant %s will be reported again: %s", subdomain, err)
+	}
+}
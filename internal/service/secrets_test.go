@@ -0,0 +1,69 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+	"github.com/qate/q8-agent/internal/service"
+)
+
+// runJob runs fn as a job of m and waits for it to finish
+func runJob(t *testing.T, m *service.JobManager, fn service.JobFunc) string {
+	t.Helper()
+	job, err := m.Submit(domain.JobProvision, "acme", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if info, _ := m.Get(job.ID); info.Done() {
+			return job.ID
+		}
+	}
+	t.Fatalf("job %s did not finish", job.ID)
+	return ""
+}
+
+func TestProvisionSecretsReportedOnce(t *testing.T) {
+	e := newTestEnv(t)
+	e.backend.SetServices("q8-acme", "web")
+	jobs := service.NewJobManager(1, 4, time.Hour)
+	jobs.Start()
+	t.Cleanup(func() { jobs.Shutdown(context.Background()) })
+
+	provision := func(ctx context.Context) error {
+		return e.o.ProvisionTenant(ctx, domain.TenantProvisionRequest{
+			ID:             "id-acme",
+			Subdomain:      "acme",
+			ComposeContent: testCompose,
+			EnvContent:     "DB_PASSWORD=${q8:secret:DB_PASSWORD}\n",
+		})
+	}
+	secrets := func(job domain.Job) map[string]string {
+		result, _ := job.Result.(domain.TenantProvisionResult)
+		return result.Secrets
+	}
+
+	// A failed provision reports nothing, and keeps the secret pending
+	e.backend.FailOn("ExecuteComposeUp", errBoom)
+	id := runJob(t, jobs, provision)
+	if job, _ := jobs.Claim(id); job.State != domain.JobFailed || job.Result != nil {
+		t.Fatalf("failed job = %s with result %v, want no result", job.State, job.Result)
+	}
+	e.backend.FailOn("ExecuteComposeUp", nil)
+
+	id = runJob(t, jobs, provision)
+	job, _ := jobs.Claim(id)
+	if job.State != domain.JobSucceeded || secrets(job)["DB_PASSWORD"] == "" {
+		t.Fatalf("job = %s with result %v, want the generated secret", job.State, job.Result)
+	}
+	if job, _ := jobs.Claim(id); job.Result != nil {
+		t.Errorf("second read of the job returned %v", job.Result)
+	}
+
+	id = runJob(t, jobs, provision)
+	if job, _ := jobs.Claim(id); job.State != domain.JobSucceeded || job.Result != nil {
+		t.Errorf("re-provision = %s with result %v, want no secrets", job.State, job.Result)
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/qate/q8-agent/internal/docker"
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// CheckServices verifies that every name in services is a service of a
+// tenant. Services are taken from the compose labels of its containers, so
+// that they match what compose itself made of the file.
+func (s *Orchestrator) CheckServices(ctx context.Context, subdomain string, services []string) error {
+	project := fmt.Sprintf("q8-%s", subdomain)
+
+	declared, err := s.docker.ComposeServices(ctx, project)
+	if err != nil {
+		return engineError("docker ps error", err)
+	}
+	if len(declared) == 0 {
+		if rec, ok := s.registry.Get(subdomain); !ok || rec.State == domain.TenantTornDown {
+			return ErrTenantNotFound
+		}
+	}
+
+	for _, svc := range services {
+		if err := domain.ValidateServiceName(svc); err != nil {
+			return err
+		}
+		if !slices.Contains(declared, svc) {
+			return &domain.Error{
+				Code:    domain.CodeServiceNotFound,
+				Message: fmt.Sprintf("tenant %s has no containers for service %q", subdomain, svc),
+				Details: map[string]any{"service": svc, "services": declared},
+			}
+		}
+	}
+	return nil
+}
+
+// RestartService restarts the containers of a single service of a tenant
+func (s *Orchestrator) RestartService(ctx context.Context, subdomain, service string) (err error) {
+	release, err := s.lock(ctx, subdomain, domain.JobRestart)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := s.admit(subdomain, domain.JobRestart); err != nil {
+		return err
+	}
+	if err := s.CheckServices(ctx, subdomain, []string{service}); err != nil {
+		return err
+	}
+	defer func() { s.record(subdomain, domain.JobRestart, err, nil) }()
+
+	log.Printf("Restarting service %s of tenant: %s", service, subdomain)
+
+	project := fmt.Sprintf("q8-%s", subdomain)
+
+	reportStep(ctx, fmt.Sprintf("restarting service %s", service))
+	if err := s.docker.ComposeRestart(ctx, project, service); err != nil {
+		return engineError("docker restart error", err)
+	}
+
+	return nil
+}
+
+// GetServiceStatus returns the status of the containers of a single service
+// of a tenant
+func (s *Orchestrator) GetServiceStatus(ctx context.Context, subdomain, service string) ([]docker.ServiceContainer, error) {
+	if err := s.CheckServices(ctx, subdomain, []string{service}); err != nil {
+		return nil, err
+	}
+
+	containers, err := s.GetTenantStatus(ctx, subdomain)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(containers, func(c docker.ServiceContainer) bool { return c.Service != service }), nil
+}
@@ -0,0 +1,41 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+func TestCheckServices(t *testing.T) {
+	e := newTestEnv(t)
+	if err := e.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		subdomain string
+		services  []string
+		code      domain.ErrorCode
+	}{
+		{name: "declared", subdomain: "acme", services: []string{"web", "worker"}},
+		{name: "unknown service", subdomain: "acme", services: []string{"web", "db"}, code: domain.CodeServiceNotFound},
+		{name: "invalid name", subdomain: "acme", services: []string{"web!"}, code: domain.CodeValidation},
+		{name: "unknown tenant", subdomain: "other", services: []string{"web"}, code: domain.CodeTenantNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := e.o.CheckServices(context.Background(), tt.subdomain, tt.services)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("CheckServices: %v", err)
+				}
+				return
+			}
+			if got := domain.CodeOf(err); got != tt.code {
+				t.Errorf("code = %s (%v), want %s", got, err, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// ErrTenantSuspended is returned for operations that would start the
+// containers of a suspended tenant, which must be resumed explicitly
+var ErrTenantSuspended = domain.NewError(domain.CodeTenantSuspended, "tenant is suspended, resume it first")
+
+// errNotSuspended is returned when resuming a tenant that is not suspended
+var errNotSuspended = domain.NewError(domain.CodeConflict, "tenant is not suspended")
+
+// admit checks that the recorded state of a tenant allows op
+func (s *Orchestrator) admit(subdomain string, op domain.JobType) error {
+	rec, ok := s.registry.Get(subdomain)
+	switch op {
+	case domain.JobProvision, domain.JobUpdate, domain.JobRestart:
+		if ok && rec.State == domain.TenantSuspended {
+			return ErrTenantSuspended
+		}
+	case domain.JobSuspend:
+		if !ok || rec.State == domain.TenantTornDown {
+			return ErrTenantNotFound
+		}
+	case domain.JobResume:
+		if !ok || rec.State == domain.TenantTornDown {
+			return ErrTenantNotFound
+		}
+		if rec.State != domain.TenantSuspended {
+			return errNotSuspended
+		}
+	case domain.JobTeardown:
+		if ok && rec.State == domain.TenantTornDown {
+			return ErrTenantNotFound
+		}
+	case domain.JobRestore:
+		if ok && rec.State != domain.TenantTornDown {
+			return errTenantExists
+		}
+	}
+	return nil
+}
+
+// SuspendTenant stops the running containers of a tenant, keeping its
+// containers, volumes and config so that ResumeTenant can start them again.
+// The stopped containers are recorded so that resume leaves the others alone.
+func (s *Orchestrator) SuspendTenant(ctx context.Context, subdomain string) (err error) {
+	release, err := s.lock(ctx, subdomain, domain.JobSuspend)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := s.admit(subdomain, domain.JobSuspend); err != nil {
+		return err
+	}
+	var stopped []string
+	defer func() {
+		s.record(subdomain, domain.JobSuspend, err, func(rec *domain.TenantRecord) {
+			// Suspending again stops nothing and must keep the first list
+			if err == nil && rec.State != domain.TenantSuspended {
+				now := time.Now().UTC()
+				rec.State = domain.TenantSuspended
+				rec.SuspendedAt = &now
+				rec.SuspendedContainers = stopped
+			}
+		})
+	}()
+
+	log.Printf("Suspending tenant: %s", subdomain)
+
+	project := fmt.Sprintf("q8-%s", subdomain)
+
+	reportStep(ctx, "stopping containers")
+	if stopped, err = s.docker.ComposeStop(ctx, project); err != nil {
+		return engineError("docker stop error", err)
+	}
+
+	return nil
+}
+
+// ResumeTenant starts again the containers the suspend of a tenant stopped
+func (s *Orchestrator) ResumeTenant(ctx context.Context, subdomain string) (err error) {
+	release, err := s.lock(ctx, subdomain, domain.JobResume)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := s.admit(subdomain, domain.JobResume); err != nil {
+		return err
+	}
+	defer func() {
+		s.record(subdomain, domain.JobResume, err, func(rec *domain.TenantRecord) {
+			if err == nil {
+				rec.State = domain.TenantActive
+				rec.SuspendedAt = nil
+				rec.SuspendedContainers = nil
+			}
+		})
+	}()
+
+	log.Printf("Resuming tenant: %s", subdomain)
+
+	project := fmt.Sprintf("q8-%s", subdomain)
+	rec, _ := s.registry.Get(subdomain)
+
+	reportStep(ctx, "starting containers")
+	if err := s.docker.ComposeStart(ctx, project, rec.SuspendedContainers); err != nil {
+		return engineError("docker start error", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+func TestSuspendResumeTenant(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	if err := e.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+	// A worker stopped on its own must stay stopped after resume
+	e.backend.SetContainerState("q8-acme", "q8-acme-worker-1", "exited")
+
+	if err := e.o.SuspendTenant(ctx, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.o.SuspendTenant(ctx, "acme"); err != nil {
+		t.Fatalf("suspending again: %v", err)
+	}
+	rec, _ := e.registry.Get("acme")
+	if rec.State != domain.TenantSuspended || len(rec.SuspendedContainers) != 1 || rec.SuspendedContainers[0] != "q8-acme-web-1" {
+		t.Fatalf("record = %s %v, want suspended with the web container", rec.State, rec.SuspendedContainers)
+	}
+
+	if err := e.o.ResumeTenant(ctx, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := e.backend.Project("q8-acme")
+	for _, c := range p.Containers {
+		want := "running"
+		if c.Service == "worker" {
+			want = "exited"
+		}
+		if c.State != want {
+			t.Errorf("%s is %s, want %s", c.Name, c.State, want)
+		}
+	}
+	rec, _ = e.registry.Get("acme")
+	if rec.State != domain.TenantActive || rec.SuspendedContainers != nil {
+		t.Errorf("record = %s %v, want active without suspended containers", rec.State, rec.SuspendedContainers)
+	}
+}
+
+func TestSuspendTenantWithoutContainers(t *testing.T) {
+	e := newTestEnv(t)
+	if err := e.provision(t, "acme", testCompose); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.backend.ExecuteComposeDown(context.Background(), "q8-acme", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	err := e.o.SuspendTenant(context.Background(), "acme")
+	if got := domain.CodeOf(err); got != domain.CodeConflict {
+		t.Fatalf("code = %s (%v), want %s", got, err, domain.CodeConflict)
+	}
+	if got := e.state(t, "acme"); got != domain.TenantActive {
+		t.Errorf("state = %s, want %s", got, domain.TenantActive)
+	}
+}
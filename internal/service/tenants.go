@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/qate/q8-agent/internal/docker"
+	"github.com/qate/q8-agent/internal/domain"
+)
+
+// ErrTenantNotFound is returned when the agent knows nothing about a tenant
+var ErrTenantNotFound = domain.NewError(domain.CodeTenantNotFound, "tenant not found")
+
+// TenantBusy describes the operation currently holding a tenant lock
+type TenantBusy struct {
+	Operation string    `json:"operation"`
+	Since     time.Time `json:"since"`
+}
+
+// TenantDetails is a tenant record enriched with its live container status
+type TenantDetails struct {
+	domain.TenantRecord
+	Busy       *TenantBusy               `json:"busy,omitempty"`
+	Containers []docker.ServiceContainer `json:"containers"`
+}
+
+// ListTenants returns the registered tenants matching filter and the total
+// number of matches before pagination
+func (s *Orchestrator) ListTenants(filter domain.TenantFilter) ([]domain.TenantRecord, int) {
+	return s.registry.List(filter)
+}
+
+// DescribeTenant returns the registry record of a tenant along with the
+// status of its containers
+func (s *Orchestrator) DescribeTenant(ctx context.Context, subdomain string) (*TenantDetails, error) {
+	rec, ok := s.registry.Get(subdomain)
+
+	containers, err := s.GetTenantStatus(ctx, subdomain)
+	if err != nil {
+		return nil, err
+	}
+	if !ok && len(containers) == 0 {
+		return nil, ErrTenantNotFound
+	}
+	if !ok {
+		// Running stack the agent has no record of
+		rec = domain.TenantRecord{Subdomain: subdomain, State: domain.TenantActive}
+	}
+
+	details := &TenantDetails{TenantRecord: rec, Containers: containers}
+	if op, since, busy := s.locks.Holder(subdomain); busy {
+		details.Busy = &TenantBusy{Operation: op, Since: since}
+	}
+	return details, nil
+}
+
+// ImportTenants registers tenant directories that predate the registry.
+// It returns the number of tenants imported.
+func (s *Orchestrator) ImportTenants() (int, error) {
+	subdomains, err := s.fs.ListTenants()
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, subdomain := range subdomains {
+		if _, ok := s.registry.Get(subdomain); ok {
+			continue
+		}
+		_, err := s.registry.Update(subdomain, func(rec *domain.TenantRecord) {
+			rec.State = domain.TenantActive
+		})
+		if err != nil {
+			return imported, fmt.Errorf("failed to import tenant %s: %w", subdomain, err)
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// record stores the outcome of op in the tenant registry and lets fn adjust
+// the record. Operations on unknown tenants other than provisioning and
+// restoring, which bring a tenant directory into place, are not recorded.
+// Registry failures are only logged: the operation already happened.
+func (s *Orchestrator) record(subdomain string, op domain.JobType, opErr error, fn func(rec *domain.TenantRecord)) {
+	if _, ok := s.registry.Get(subdomain); !ok && op != domain.JobProvision && op != domain.JobRestore {
+		return
+	}
+
+	_, err := s.registry.Update(subdomain, func(rec *domain.TenantRecord) {
+		now := time.Now().UTC()
+		rec.LastOperation = op
+		rec.LastOperationAt = &now
+		if opErr != nil {
+			rec.LastResult = domain.JobFailed
+			rec.LastError = opErr.Error()
+		} else {
+			rec.LastResult = domain.JobSucceeded
+			rec.LastError = ""
+		}
+		if fn != nil {
+			fn(rec)
+		}
+	})
+	if err != nil {
+		log.Printf("Warning: failed to record %s of tenant %s: %s", op, subdomain, err)
+	}
+}
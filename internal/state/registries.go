@@ -0,0 +1,267 @@
+package state
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+	"github.com/qate/q8-agent/internal/secure"
+)
+
+// Credential sources
+const (
+	SourceAPI  = "api"
+	SourceFile = "file"
+	SourceEnv  = "env"
+)
+
+// dockerHubAuthKey is the key docker uses for Docker Hub in config.json
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+var registryHostPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?(:[0-9]{1,5})?$`)
+
+// ErrStaticCredential is returned when deleting credentials that come from
+// the agent configuration rather than the API
+var ErrStaticCredential = domain.NewError(domain.CodeConflict, "credentials are configured by file or environment")
+
+// registryCredential is a stored registry login
+type registryCredential struct {
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	Source    string    `json:"source"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RegistryStore holds per-registry credentials used for image pulls.
+// Credentials set through the API are persisted; configured ones are not.
+type RegistryStore struct {
+	mu      sync.Mutex
+	path    string
+	tmpDir  string
+	cipher  *secure.Cipher
+	entries map[string]registryCredential
+}
+
+// OpenRegistries loads the credentials persisted at path, encrypted with c
+// when it holds a key. Temporary docker configs are created under tmpDir,
+// which must not be a tenant directory.
+func OpenRegistries(path, tmpDir string, c *secure.Cipher) (*RegistryStore, error) {
+	s := &RegistryStore{
+		path:    path,
+		tmpDir:  tmpDir,
+		cipher:  c,
+		entries: make(map[string]registryCredential),
+	}
+
+	data, err := readSealed(path, c)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry credentials: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse registry credentials %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// ValidateRegistryHost checks that host is a bare registry host with optional port
+func ValidateRegistryHost(host string) error {
+	if len(host) > 255 || !registryHostPattern.MatchString(host) {
+		return &domain.ValidationError{Field: "host", Value: host, Reason: "must be a registry hostname with an optional port"}
+	}
+	return nil
+}
+
+// LoadFile adds the credentials of a JSON file mapping hosts to
+// {"username", "password"} objects. They take precedence over persisted ones.
+func (s *RegistryStore) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read registry auth file: %w", err)
+	}
+
+	var file map[string]domain.RegistryCredentialRequest
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse registry auth file %s: %w", path, err)
+	}
+
+	for host, cred := range file {
+		if err := s.setStatic(host, cred, SourceFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadEnv adds a single registry login configured through the environment
+func (s *RegistryStore) LoadEnv(host, username, password string) error {
+	return s.setStatic(host, domain.RegistryCredentialRequest{Username: username, Password: password}, SourceEnv)
+}
+
+// Set stores the credentials of host and persists them
+func (s *RegistryStore) Set(host string, cred domain.RegistryCredentialRequest) error {
+	if err := ValidateRegistryHost(host); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.entries[host]
+	s.entries[host] = registryCredential{
+		Username:  cred.Username,
+		Password:  cred.Password,
+		Source:    SourceAPI,
+		UpdatedAt: time.Now().UTC(),
+	}
+	if err := s.saveLocked(); err != nil {
+		s.restoreLocked(host, prev, existed)
+		return err
+	}
+	return nil
+}
+
+// Delete removes the API-managed credentials of host. It reports whether
+// credentials existed.
+func (s *RegistryStore) Delete(host string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.entries[host]
+	if !ok {
+		return false, nil
+	}
+	if prev.Source != SourceAPI {
+		return true, ErrStaticCredential
+	}
+
+	delete(s.entries, host)
+	if err := s.saveLocked(); err != nil {
+		s.entries[host] = prev
+		return true, err
+	}
+	return true, nil
+}
+
+// List describes the configured registries, without their passwords
+func (s *RegistryStore) List() []domain.RegistryInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]domain.RegistryInfo, 0, len(s.entries))
+	for host, cred := range s.entries {
+		infos = append(infos, domain.RegistryInfo{
+			Host:      host,
+			Username:  cred.Username,
+			Source:    cred.Source,
+			UpdatedAt: cred.UpdatedAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Host < infos[j].Host })
+	return infos
+}
+
+// DockerConfig writes a throwaway docker config directory holding every
+// registry login and returns it with a cleanup function. It returns an empty
+// path when no credentials are configured.
+func (s *RegistryStore) DockerConfig() (string, func(), error) {
+	s.mu.Lock()
+	auths := make(map[string]map[string]string, len(s.entries))
+	for host, cred := range s.entries {
+		key := host
+		if host == "docker.io" || host == "index.docker.io" {
+			key = dockerHubAuthKey
+		}
+		token := base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password))
+		auths[key] = map[string]string{"auth": token}
+	}
+	s.mu.Unlock()
+
+	if len(auths) == 0 {
+		return "", func() {}, nil
+	}
+
+	data, err := json.Marshal(map[string]any{"auths": auths})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := os.MkdirAll(s.tmpDir, 0700); err != nil {
+		return "", nil, fmt.Errorf("failed to create docker config directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(s.tmpDir, "docker-config-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create docker config directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0600); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write docker config: %w", err)
+	}
+	return dir, cleanup, nil
+}
+
+func (s *RegistryStore) setStatic(host string, cred domain.RegistryCredentialRequest, source string) error {
+	if err := ValidateRegistryHost(host); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[host] = registryCredential{
+		Username:  cred.Username,
+		Password:  cred.Password,
+		Source:    source,
+		UpdatedAt: time.Now().UTC(),
+	}
+	return nil
+}
+
+func (s *RegistryStore) restoreLocked(host string, prev registryCredential, existed bool) {
+	if existed {
+		s.entries[host] = prev
+	} else {
+		delete(s.entries, host)
+	}
+}
+
+// saveLocked persists the API-managed credentials. The caller must hold s.mu.
+func (s *RegistryStore) saveLocked() error {
+	persisted := make(map[string]registryCredential)
+	for host, cred := range s.entries {
+		if cred.Source == SourceAPI {
+			persisted[host] = cred
+		}
+	}
+
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeSealed(s.path, data, s.cipher)
+}
+
+// Reseal persists the API-managed credentials again under c
+func (s *RegistryStore) Reseal(c *secure.Cipher) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.cipher
+	s.cipher = c
+	if err := s.saveLocked(); err != nil {
+		s.cipher = prev
+		return err
+	}
+	return nil
+}
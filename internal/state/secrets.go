@@ -0,0 +1,194 @@
+package state
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qate/q8-agent/internal/secure"
+)
+
+// secretBytes is the entropy of generated secrets
+const secretBytes = 32
+
+// secret is a generated tenant secret
+type secret struct {
+	Value     string    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+	// Pending marks a secret no successful provision has reported yet
+	Pending bool `json:"pending,omitempty"`
+}
+
+// SecretStore keeps the secrets generated for tenants so they stay stable
+// across re-provisions. It is safe for concurrent use.
+type SecretStore struct {
+	mu      sync.Mutex
+	path    string
+	cipher  *secure.Cipher
+	tenants map[string]map[string]secret
+}
+
+// OpenSecrets loads the secrets persisted at path, encrypted with c when it
+// holds a key
+func OpenSecrets(path string, c *secure.Cipher) (*SecretStore, error) {
+	s := &SecretStore{
+		path:    path,
+		cipher:  c,
+		tenants: make(map[string]map[string]secret),
+	}
+
+	data, err := readSealed(path, c)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Ensure returns the values of the named secrets of a tenant, generating the
+// missing ones. It also returns the names of the pending secrets among them,
+// sorted: those generated by this call and those Confirm was not called for.
+func (s *SecretStore) Ensure(subdomain string, names []string) (map[string]string, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.tenants[subdomain]
+	values := make(map[string]string, len(names))
+	generated := make(map[string]secret)
+	var pending []string
+	for _, name := range names {
+		if sec, ok := existing[name]; ok {
+			values[name] = sec.Value
+			if sec.Pending && !slices.Contains(pending, name) {
+				pending = append(pending, name)
+			}
+			continue
+		}
+		if _, ok := generated[name]; ok {
+			continue
+		}
+
+		value, err := newSecret()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate secret: %w", err)
+		}
+		generated[name] = secret{Value: value, CreatedAt: time.Now().UTC(), Pending: true}
+		values[name] = value
+	}
+
+	if len(generated) == 0 {
+		sort.Strings(pending)
+		return values, pending, nil
+	}
+
+	updated := maps.Clone(existing)
+	if updated == nil {
+		updated = make(map[string]secret, len(generated))
+	}
+	for name, sec := range generated {
+		updated[name] = sec
+		pending = append(pending, name)
+	}
+	sort.Strings(pending)
+
+	s.tenants[subdomain] = updated
+	if err := s.saveLocked(); err != nil {
+		if existing == nil {
+			delete(s.tenants, subdomain)
+		} else {
+			s.tenants[subdomain] = existing
+		}
+		return nil, nil, err
+	}
+	return values, pending, nil
+}
+
+// Confirm clears the pending mark of the named secrets of a tenant, once
+// their values have been reported
+func (s *SecretStore) Confirm(subdomain string, names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.tenants[subdomain]
+	updated := maps.Clone(existing)
+	changed := false
+	for _, name := range names {
+		if sec, ok := updated[name]; ok && sec.Pending {
+			sec.Pending = false
+			updated[name] = sec
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	s.tenants[subdomain] = updated
+	if err := s.saveLocked(); err != nil {
+		s.tenants[subdomain] = existing
+		return err
+	}
+	return nil
+}
+
+// Delete forgets the secrets of a tenant
+func (s *SecretStore) Delete(subdomain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.tenants[subdomain]
+	if !ok {
+		return nil
+	}
+	delete(s.tenants, subdomain)
+	if err := s.saveLocked(); err != nil {
+		s.tenants[subdomain] = existing
+		return err
+	}
+	return nil
+}
+
+// saveLocked persists the secrets. The caller must hold s.mu.
+func (s *SecretStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.tenants, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeSealed(s.path, data, s.cipher)
+}
+
+// Reseal persists the secrets again under c
+func (s *SecretStore) Reseal(c *secure.Cipher) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.cipher
+	s.cipher = c
+	if err := s.saveLocked(); err != nil {
+		s.cipher = prev
+		return err
+	}
+	return nil
+}
+
+// newSecret returns a random URL-safe value usable as-is in a .env file
+func newSecret() (string, error) {
+	b := make([]byte, secretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,206 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qate/q8-agent/internal/domain"
+	"github.com/qate/q8-agent/internal/secure"
+)
+
+// Store is a tenant registry persisted as a single JSON file
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	tenants map[string]domain.TenantRecord
+}
+
+// Open loads the registry at path, starting empty when the file does not exist
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		tenants: make(map[string]domain.TenantRecord),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant registry: %w", err)
+	}
+
+	var records []domain.TenantRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant registry %s: %w", path, err)
+	}
+	for _, rec := range records {
+		s.tenants[rec.Subdomain] = rec
+	}
+	return s, nil
+}
+
+// Get returns the record of a tenant
+func (s *Store) Get(subdomain string) (domain.TenantRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.tenants[subdomain]
+	return rec, ok
+}
+
+// Update applies fn to the record of a tenant, creating it if needed, and
+// persists the registry
+func (s *Store) Update(subdomain string, fn func(rec *domain.TenantRecord)) (domain.TenantRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	rec, ok := s.tenants[subdomain]
+	if !ok {
+		rec = domain.TenantRecord{Subdomain: subdomain, CreatedAt: now}
+	}
+	fn(&rec)
+	rec.Subdomain = subdomain
+	rec.UpdatedAt = now
+
+	prev, existed := s.tenants[subdomain]
+	s.tenants[subdomain] = rec
+	if err := s.saveLocked(); err != nil {
+		if existed {
+			s.tenants[subdomain] = prev
+		} else {
+			delete(s.tenants, subdomain)
+		}
+		return domain.TenantRecord{}, err
+	}
+	return rec, nil
+}
+
+// Delete forgets a tenant
+func (s *Store) Delete(subdomain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.tenants[subdomain]
+	if !ok {
+		return nil
+	}
+	delete(s.tenants, subdomain)
+	if err := s.saveLocked(); err != nil {
+		s.tenants[subdomain] = prev
+		return err
+	}
+	return nil
+}
+
+// List returns the records matching filter ordered by subdomain, along with
+// the total number of matches before pagination
+func (s *Store) List(filter domain.TenantFilter) ([]domain.TenantRecord, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := strings.ToLower(filter.Query)
+	matches := make([]domain.TenantRecord, 0, len(s.tenants))
+	for _, rec := range s.tenants {
+		if filter.State != "" && rec.State != filter.State {
+			continue
+		}
+		if len(filter.Subdomains) > 0 && !slices.Contains(filter.Subdomains, rec.Subdomain) {
+			continue
+		}
+		if query != "" && !strings.Contains(rec.Subdomain, query) && !strings.Contains(strings.ToLower(rec.ID), query) {
+			continue
+		}
+		matches = append(matches, rec)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Subdomain < matches[j].Subdomain
+	})
+
+	total := len(matches)
+	if filter.Offset >= total {
+		return []domain.TenantRecord{}, total
+	}
+	matches = matches[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(matches) {
+		matches = matches[:filter.Limit]
+	}
+	return matches, total
+}
+
+// saveLocked atomically rewrites the registry file. The caller must hold s.mu.
+func (s *Store) saveLocked() error {
+	records := make([]domain.TenantRecord, 0, len(s.tenants))
+	for _, rec := range s.tenants {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Subdomain < records[j].Subdomain
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers never observe a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+// readSealed reads a state file, decrypting it when it is encrypted
+func readSealed(path string, c *secure.Cipher) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := c.Open(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return plain, nil
+}
+
+// writeSealed atomically writes a state file, encrypted when c holds a key
+func writeSealed(path string, data []byte, c *secure.Cipher) error {
+	sealed, err := c.Seal(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, sealed)
+}
@@ -0,0 +1,150 @@
+package system
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cpuTimes is a snapshot of the aggregate "cpu" line of /proc/stat
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+// readCPUTimes returns the aggregate CPU times and the number of cores
+func readCPUTimes(procRoot string) (cpuTimes, int, error) {
+	f, err := os.Open(procRoot + "/stat")
+	if err != nil {
+		return cpuTimes{}, 0, err
+	}
+	defer f.Close()
+
+	var times cpuTimes
+	cores := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if fields[0] != "cpu" {
+			cores++
+			continue
+		}
+
+		// user nice system idle iowait irq softirq steal [guest guest_nice]
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpuTimes{}, 0, fmt.Errorf("invalid /proc/stat cpu field %q", field)
+			}
+			if i >= 8 {
+				break // guest time is already accounted in user time
+			}
+			times.total += v
+			if i == 3 || i == 4 {
+				times.idle += v
+			}
+		}
+	}
+	return times, cores, scanner.Err()
+}
+
+// readLoad parses /proc/loadavg
+func readLoad(procRoot string) (LoadStats, error) {
+	data, err := os.ReadFile(procRoot + "/loadavg")
+	if err != nil {
+		return LoadStats{}, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return LoadStats{}, fmt.Errorf("unexpected /proc/loadavg format: %q", data)
+	}
+
+	var load [3]float64
+	for i := range load {
+		if load[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return LoadStats{}, fmt.Errorf("invalid /proc/loadavg value %q", fields[i])
+		}
+	}
+	return LoadStats{Load1: load[0], Load5: load[1], Load15: load[2]}, nil
+}
+
+// readMemory parses the relevant lines of /proc/meminfo
+func readMemory(procRoot string) (MemoryStats, error) {
+	f, err := os.Open(procRoot + "/meminfo")
+	if err != nil {
+		return MemoryStats{}, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "MemAvailable:    5670292 kB"
+		key, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			v *= 1024
+		}
+		values[key] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return MemoryStats{}, err
+	}
+
+	mem := MemoryStats{
+		TotalBytes:     values["MemTotal"],
+		AvailableBytes: values["MemAvailable"],
+		SwapTotalBytes: values["SwapTotal"],
+		SwapFreeBytes:  values["SwapFree"],
+	}
+	if mem.TotalBytes > mem.AvailableBytes {
+		mem.UsedBytes = mem.TotalBytes - mem.AvailableBytes
+	}
+	mem.UsedPercent = percent(mem.UsedBytes, mem.TotalBytes)
+	return mem, nil
+}
+
+// readDisk returns the usage of the filesystem holding path
+func readDisk(path string) (DiskStats, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return DiskStats{}, err
+	}
+
+	bsize := uint64(st.Bsize)
+	disk := DiskStats{
+		Path:           path,
+		TotalBytes:     st.Blocks * bsize,
+		AvailableBytes: st.Bavail * bsize,
+		UsedBytes:      (st.Blocks - st.Bfree) * bsize,
+		TotalInodes:    st.Files,
+		FreeInodes:     st.Ffree,
+	}
+	// Like df, relate usage to the space available to unprivileged users
+	disk.UsedPercent = percent(disk.UsedBytes, disk.UsedBytes+disk.AvailableBytes)
+	return disk, nil
+}
+
+func percent(part, whole uint64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(whole)
+}
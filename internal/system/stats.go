@@ -0,0 +1,172 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/qate/q8-agent/internal/docker"
+)
+
+// cpuSampleInterval is the window over which CPU usage is measured
+const cpuSampleInterval = 250 * time.Millisecond
+
+// tenantProjectPrefix is the compose project prefix of tenant stacks
+const tenantProjectPrefix = "q8-"
+
+// CPUStats describes processor capacity and usage
+type CPUStats struct {
+	Cores        int     `json:"cores"`
+	UsagePercent float64 `json:"usage_percent"`
+}
+
+// LoadStats is the system load average
+type LoadStats struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+// MemoryStats describes memory usage; used memory excludes reclaimable caches
+type MemoryStats struct {
+	TotalBytes     uint64  `json:"total_bytes"`
+	AvailableBytes uint64  `json:"available_bytes"`
+	UsedBytes      uint64  `json:"used_bytes"`
+	UsedPercent    float64 `json:"used_percent"`
+	SwapTotalBytes uint64  `json:"swap_total_bytes"`
+	SwapFreeBytes  uint64  `json:"swap_free_bytes"`
+}
+
+// DiskStats describes the filesystem holding the tenants root
+type DiskStats struct {
+	Path           string  `json:"path"`
+	TotalBytes     uint64  `json:"total_bytes"`
+	AvailableBytes uint64  `json:"available_bytes"`
+	UsedBytes      uint64  `json:"used_bytes"`
+	UsedPercent    float64 `json:"used_percent"`
+	TotalInodes    uint64  `json:"total_inodes"`
+	FreeInodes     uint64  `json:"free_inodes"`
+}
+
+// ContainerCounts counts containers by state
+type ContainerCounts struct {
+	Total   int `json:"total"`
+	Running int `json:"running"`
+}
+
+// ContainerStats counts the containers of the host and of each tenant
+type ContainerStats struct {
+	ContainerCounts
+	TenantContainers ContainerCounts            `json:"tenant_containers"`
+	Tenants          map[string]ContainerCounts `json:"tenants"`
+}
+
+// Stats is a snapshot of host telemetry
+type Stats struct {
+	Hostname   string         `json:"hostname"`
+	Timestamp  time.Time      `json:"timestamp"`
+	CPU        CPUStats       `json:"cpu"`
+	Load       LoadStats      `json:"load"`
+	Memory     MemoryStats    `json:"memory"`
+	Disk       DiskStats      `json:"disk"`
+	Containers ContainerStats `json:"containers"`
+}
+
+// ContainerLister lists containers carrying the given labels
+type ContainerLister interface {
+	ListContainers(ctx context.Context, labels ...string) ([]docker.Container, error)
+}
+
+// Collector gathers host telemetry from /proc, statfs and the Docker Engine
+type Collector struct {
+	procRoot    string
+	tenantsRoot string
+	containers  ContainerLister
+}
+
+// NewCollector creates a collector reporting disk usage of tenantsRoot
+func NewCollector(tenantsRoot string, containers ContainerLister) *Collector {
+	return &Collector{
+		procRoot:    "/proc",
+		tenantsRoot: tenantsRoot,
+		containers:  containers,
+	}
+}
+
+// Collect takes a snapshot of host telemetry. It blocks for about
+// cpuSampleInterval to measure CPU usage.
+func (c *Collector) Collect(ctx context.Context) (*Stats, error) {
+	before, cores, err := readCPUTimes(c.procRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cpu stats: %w", err)
+	}
+
+	stats := &Stats{Timestamp: time.Now().UTC()}
+	stats.Hostname, _ = os.Hostname()
+
+	if stats.Load, err = readLoad(c.procRoot); err != nil {
+		return nil, fmt.Errorf("failed to read load average: %w", err)
+	}
+	if stats.Memory, err = readMemory(c.procRoot); err != nil {
+		return nil, fmt.Errorf("failed to read memory stats: %w", err)
+	}
+	if stats.Disk, err = readDisk(c.tenantsRoot); err != nil {
+		return nil, fmt.Errorf("failed to read disk stats: %w", err)
+	}
+	if stats.Containers, err = c.countContainers(ctx); err != nil {
+		return nil, fmt.Errorf("failed to count containers: %w", err)
+	}
+
+	select {
+	case <-time.After(cpuSampleInterval):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	after, _, err := readCPUTimes(c.procRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cpu stats: %w", err)
+	}
+	stats.CPU = CPUStats{Cores: cores}
+	if total := after.total - before.total; total > 0 {
+		busy := total - (after.idle - before.idle)
+		stats.CPU.UsagePercent = percent(busy, total)
+	}
+
+	return stats, nil
+}
+
+// countContainers counts all containers and groups tenant containers by subdomain
+func (c *Collector) countContainers(ctx context.Context) (ContainerStats, error) {
+	containers, err := c.containers.ListContainers(ctx)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+
+	stats := ContainerStats{Tenants: make(map[string]ContainerCounts)}
+	for _, ctr := range containers {
+		running := ctr.State == "running"
+		stats.add(running)
+
+		project := ctr.Labels[docker.LabelProject]
+		if !strings.HasPrefix(project, tenantProjectPrefix) {
+			continue
+		}
+		stats.TenantContainers.add(running)
+
+		subdomain := strings.TrimPrefix(project, tenantProjectPrefix)
+		tenant := stats.Tenants[subdomain]
+		tenant.add(running)
+		stats.Tenants[subdomain] = tenant
+	}
+	return stats, nil
+}
+
+func (c *ContainerCounts) add(running bool) {
+	c.Total++
+	if running {
+		c.Running++
+	}
+}